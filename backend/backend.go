@@ -2,6 +2,7 @@ package backend
 
 import (
 	"log"
+	"math"
 	"strings"
 	"errors"
 	"time"
@@ -13,10 +14,16 @@ import (
 	"github.com/olegfedoseev/opentsdb"
 	"bytes"
 	"github.com/pquerna/ffjson/ffjson"
+	"golang.org/x/net/context"
 	"compress/gzip"
 	"net/http"
+	"net/url"
+	"net"
 	"fmt"
-	//"encoding/json"
+	"reflect"
+	"io"
+	"io/ioutil"
+	"encoding/json"
 )
 
 type FinderStuct struct {
@@ -32,36 +39,43 @@ type FinderInfo struct {
 }
 
 type Point struct {
-	VCenter    string
-	ObjectType string
-	ObjectName string
-	Group      string
-	Counter    string
-	Instance   string
-	Rollup     string
-	Value      int64
-	Datastore  []string
-	ESXi       string
-	Cluster    string
-	Network    []string
-	Timestamp  int64
+	VCenter     string
+	ObjectType  string
+	ObjectName  string
+	Group       string
+	Counter     string
+	Instance    string
+	Rollup      string
+	Value       float64
+	Float       bool              `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+	MoRef       string            `json:",omitempty"`
+	VCenterUUID string            `json:",omitempty"`
+	UUID        string            `json:",omitempty"`
+	Span        time.Duration     `json:"-"`
+	Timestamp   int64
 }
 
 //Storage backend
 type Backend struct {
-	ApiKey    string
-	MetricUrl string
-	FinderUrl string
-	Hostname  string
-	Port      int
-	Database  string
-	Username  string
-	Password  string
-	Type      string
-	NoArray   bool
-	carbon    *graphite.Graphite
-	influx    influxclient.Client
-	opentsdb  *opentsdb.Client
+	ApiKey           string
+	MetricUrl        string
+	FinderUrl        string
+	Hostname         string
+	Port             int
+	Database         string
+	Username         string
+	Password         string
+	Type             string
+	NoArray          bool
+	Naming           string
+	DatacenterInPath bool
+	InfluxFloats     bool
+	Labels           []string
+	Rename           map[string]string
+	carbon           *graphite.Graphite
+	influx           influxclient.Client
+	opentsdb         *opentsdb.Client
 }
 
 var stdlog, errlog *log.Logger
@@ -111,6 +125,69 @@ func (backend *Backend) Init(standardLogs *log.Logger, errorLogs *log.Logger) er
 	}
 }
 
+// Equals checks if two backends have the same settings (connections are ignored)
+func (backend *Backend) Equals(other *Backend) bool {
+	a := reflect.ValueOf(backend).Elem()
+	b := reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		if !a.Field(i).CanInterface() {
+			// unexported field
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check verifies that the backend is reachable
+func (backend *Backend) Check() error {
+	switch backendType := strings.ToLower(backend.Type); backendType {
+	case "graphite", "opentsdb":
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(backend.Hostname, strconv.Itoa(backend.Port)), 5*time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "influxdb":
+		influxclt, err := influxclient.NewHTTPClient(influxclient.HTTPConfig{
+			Addr:     "http://" + backend.Hostname + ":" + strconv.Itoa(backend.Port),
+			Username: backend.Username,
+			Password: backend.Password,
+		})
+		if err != nil {
+			return err
+		}
+		defer influxclt.Close()
+		_, _, err = influxclt.Ping(5 * time.Second)
+		return err
+	case "kong":
+		for _, endpoint := range []string{backend.MetricUrl, backend.FinderUrl} {
+			u, err := url.Parse(endpoint)
+			if err != nil {
+				return err
+			}
+			host := u.Host
+			if len(u.Port()) == 0 {
+				if u.Scheme == "https" {
+					host = net.JoinHostPort(u.Hostname(), "443")
+				} else {
+					host = net.JoinHostPort(u.Hostname(), "80")
+				}
+			}
+			conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			conn.Close()
+		}
+		return nil
+	default:
+		return errors.New("Backend " + backendType + " unknown.")
+	}
+}
+
 func (backend *Backend) Disconnect() {
 
 	switch backendType := strings.ToLower(backend.Type); backendType {
@@ -131,7 +208,8 @@ func (backend *Backend) Disconnect() {
 	}
 }
 
-func (backend *Backend) SendMetrics(metrics []Point) {
+// SendMetrics sends the points to the backend, the context bounds the http based backends
+func (backend *Backend) SendMetrics(ctx context.Context, metrics []Point) error {
 	switch backendType := strings.ToLower(backend.Type); backendType {
 	case "opentsdb":
 		var tsdbMetrics opentsdb.DataPoints
@@ -142,26 +220,24 @@ func (backend *Backend) SendMetrics(metrics []Point) {
 				key += "." + strings.ToLower(strings.Replace(point.Instance, ".", "_", -1))
 			}*/
 
-			tags := opentsdb.Tags{}
-
-			tags["host"] = point.VCenter
-			tags[point.ObjectType] = point.ObjectName
-			if len(point.Instance) > 0 {
-				tags["instance"] = strings.ToLower(strings.Replace(point.Instance, ".", "_", -1))
-			}
+			tags := backend.tsdbTags(point)
 
 			tsdbMetrics = append(tsdbMetrics, &opentsdb.DataPoint{
 				Metric:    point.Group + "." + point.Counter + "." + point.Rollup,
-				Value:     strconv.FormatInt(point.Value, 10),
+				Value:     formatValue(point),
 				Timestamp: point.Timestamp,
 				Tags:      tags})
 		}
 		//b, _:= json.Marshal(tsdbMetrics)
 		//fmt.Println(string(b))
 		postman := opentsdb.NewPostman(10 * time.Second)
-		backend.opentsdb.Send(postman, tsdbMetrics)
+		err := backend.opentsdb.Send(postman, tsdbMetrics)
 		postman = nil
 		tsdbMetrics = nil
+		if err != nil {
+			errlog.Println("Error sending metrics: ", err)
+		}
+		return err
 		//err := backend.carbon.SendMetrics(graphiteMetrics)
 		//if err != nil {
 		//	errlog.Println("Error sending metrics (trying to reconnect): ", err)
@@ -170,18 +246,14 @@ func (backend *Backend) SendMetrics(metrics []Point) {
 	case "graphite":
 		var graphiteMetrics []graphite.Metric
 		for _, point := range metrics {
-			//key := "vsphere." + vcName + "." + entityName + "." + name + "." + metricName
-			key := "vsphere." + point.VCenter + "." + point.ObjectType + "." + point.ObjectName + "." + point.Group + "." + point.Counter + "." + point.Rollup
-			if len(point.Instance) > 0 {
-				key += "." + strings.ToLower(strings.Replace(point.Instance, ".", "_", -1))
-			}
-			graphiteMetrics = append(graphiteMetrics, graphite.Metric{Name: key, Value: strconv.FormatInt(point.Value, 10), Timestamp: point.Timestamp})
+			graphiteMetrics = append(graphiteMetrics, graphite.Metric{Name: backend.graphiteKey(point), Value: formatValue(point), Timestamp: point.Timestamp})
 		}
 		err := backend.carbon.SendMetrics(graphiteMetrics)
 		if err != nil {
 			errlog.Println("Error sending metrics (trying to reconnect): ", err)
 			backend.carbon.Connect()
 		}
+		return err
 	case "influxdb":
 		//Influx batch points
 		bp, err := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{
@@ -191,38 +263,10 @@ func (backend *Backend) SendMetrics(metrics []Point) {
 		if err != nil {
 			errlog.Println("Error creating influx batchpoint")
 			errlog.Println(err)
-			return
+			return err
 		}
 		for _, point := range metrics {
-			key := point.Group + "_" + point.Counter + "_" + point.Rollup
-			tags := map[string]string{}
-			tags["vcenter"] = point.VCenter
-			tags["type"] = point.ObjectType
-			tags["name"] = point.ObjectName
-			if backend.NoArray {
-				if len(point.Datastore) > 0 {
-					tags["datastore"] = point.Datastore[0]
-				} else {
-					tags["datastore"] = ""
-				}
-			} else {
-				tags["datastore"] = strings.Join(point.Datastore, "\\,")
-			}
-			if backend.NoArray {
-				if len(point.Network) > 0 {
-					tags["network"] = point.Network[0]
-				} else {
-					tags["network"] = ""
-				}
-			} else {
-				tags["network"] = strings.Join(point.Network, "\\,")
-			}
-			tags["host"] = point.ESXi
-			tags["cluster"] = point.Cluster
-			tags["instance"] = point.Instance
-			fields := make(map[string]interface{})
-			fields["Value"] = point.Value
-			pt, err := influxclient.NewPoint(key, tags, fields, time.Unix(point.Timestamp, 0))
+			pt, err := backend.influxPoint(point)
 			if err != nil {
 				errlog.Println("Could not create influxdb point")
 				errlog.Println(err)
@@ -234,6 +278,7 @@ func (backend *Backend) SendMetrics(metrics []Point) {
 		if err != nil {
 			errlog.Println("Error sending metrics: ", err)
 		}
+		return err
 	case "kong":
 		var tsdbMetrics opentsdb.DataPoints
 		var host string
@@ -244,20 +289,14 @@ func (backend *Backend) SendMetrics(metrics []Point) {
 				key += "." + strings.ToLower(strings.Replace(point.Instance, ".", "_", -1))
 			}*/
 
-			tags := opentsdb.Tags{}
 			if host == "" {
 				host = point.VCenter
 			}
-
-			tags["host"] = point.VCenter
-			tags[point.ObjectType] = point.ObjectName
-			if len(point.Instance) > 0 {
-				tags["instance"] = strings.ToLower(strings.Replace(point.Instance, ".", "_", -1))
-			}
+			tags := backend.tsdbTags(point)
 
 			tsdbMetrics = append(tsdbMetrics, &opentsdb.DataPoint{
 				Metric:    point.Group + "." + point.Counter + "." + point.Rollup,
-				Value:     strconv.FormatInt(point.Value, 10),
+				Value:     formatValue(point),
 				Timestamp: point.Timestamp,
 				Tags:      tags})
 		}
@@ -265,9 +304,13 @@ func (backend *Backend) SendMetrics(metrics []Point) {
 		//fmt.Println(string(b))
 
 		url := fmt.Sprintf("%s?api_key=%s&host=%s", backend.MetricUrl, backend.ApiKey, host)
-		backend.SendNetrics2tsdb(tsdbMetrics, url)
+		err := backend.SendNetrics2tsdb(ctx, tsdbMetrics, url)
 
 		tsdbMetrics = nil
+		if err != nil {
+			errlog.Println("Error sending metrics: ", err)
+		}
+		return err
 		//err := backend.carbon.SendMetrics(graphiteMetrics)
 		//if err != nil {
 		//	errlog.Println("Error sending metrics (trying to reconnect): ", err)
@@ -276,10 +319,201 @@ func (backend *Backend) SendMetrics(metrics []Point) {
 
 	default:
 		errlog.Println("Backend " + backendType + " unknown.")
+		return errors.New("Backend " + backendType + " unknown.")
+	}
+}
+
+// tsdbTag replaces the characters opentsdb doesn't allow in tags
+func tsdbTag(value string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' || r == '/' {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+// formatValue formats the value of a point, points from integer counters stay integers
+func formatValue(point Point) string {
+	if point.Float {
+		return strconv.FormatFloat(point.Value, 'f', -1, 64)
 	}
+	return strconv.FormatInt(int64(point.Value), 10)
 }
 
-func (backend *Backend) SendNetrics2tsdb(values opentsdb.DataPoints, url string) (error) {
+// graphiteKey returns the graphite path of a point
+func (backend *Backend) graphiteKey(point Point) string {
+	//key := "vsphere." + vcName + "." + entityName + "." + name + "." + metricName
+	location := point.VCenter
+	if datacenter, ok := point.Labels["datacenter"]; ok && backend.DatacenterInPath {
+		location += "." + strings.Replace(datacenter, ".", "_", -1)
+	}
+	key := "vsphere." + location + "." + point.ObjectType + "." + strings.Replace(backend.objectName(point), ".", "_", -1) + "." + point.Group + "." + point.Counter + "." + point.Rollup
+	if point.Group == "guest" && len(point.Instance) > 0 {
+		key += "." + graphiteInstance(point.Instance)
+	} else if len(point.Instance) > 0 {
+		key += "." + strings.ToLower(strings.Replace(point.Instance, ".", "_", -1))
+	}
+	return key
+}
+
+// graphiteInstance makes a guest disk path usable as a graphite path node: characters other than letters, digits,
+// dashes and underscores are replaced, i.e.: the disk path C:\ is c and the root file system / is root.
+// Instances of performance counters keep their name so that existing series are not renamed.
+func graphiteInstance(instance string) string {
+	node := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(instance))
+	node = strings.Trim(node, "_")
+	if len(node) == 0 {
+		return "root"
+	}
+	return node
+}
+
+// labels applies the include and rename rules of the backend to the labels of a point
+func (backend *Backend) labels(point Point) map[string]string {
+	labels := make(map[string]string, len(point.Labels))
+	for key, value := range point.Labels {
+		if len(backend.Labels) > 0 {
+			included := false
+			for _, label := range backend.Labels {
+				if label == key {
+					included = true
+					break
+				}
+			}
+			if !included {
+				continue
+			}
+		}
+		if renamed, ok := backend.Rename[key]; ok {
+			key = renamed
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// objectName returns the identifier of the object of a point following the naming strategy:
+// name (default), moref or uuid. Objects without a uuid fall back to the moref, objects without a moref to the name.
+func (backend *Backend) objectName(point Point) string {
+	switch strings.ToLower(backend.Naming) {
+	case "uuid":
+		if len(point.UUID) > 0 {
+			return point.UUID
+		}
+		fallthrough
+	case "moref":
+		if len(point.MoRef) > 0 {
+			return point.MoRef
+		}
+	}
+	return point.ObjectName
+}
+
+// identifiers returns the tags keeping the object recognisable when it is not named by its name:
+// the name itself and, as morefs are only unique per vcenter, the vcenter uuid
+func (backend *Backend) identifiers(point Point) map[string]string {
+	identifiers := map[string]string{}
+	if name := backend.objectName(point); name != point.ObjectName {
+		identifiers["objectname"] = point.ObjectName
+		if len(point.VCenterUUID) > 0 {
+			identifiers["vcenteruuid"] = point.VCenterUUID
+		}
+	}
+	return identifiers
+}
+
+// influxPoint converts a point to an influxdb point
+func (backend *Backend) influxPoint(point Point) (*influxclient.Point, error) {
+	key := point.Group + "_" + point.Counter + "_" + point.Rollup
+	tags := map[string]string{}
+	for label, value := range backend.labels(point) {
+		if backend.NoArray {
+			// only keep the first element of lists
+			value = strings.SplitN(value, ",", 2)[0]
+		}
+		tags[label] = value
+	}
+	tags["vcenter"] = point.VCenter
+	tags["type"] = point.ObjectType
+	tags["name"] = backend.objectName(point)
+	for label, value := range backend.identifiers(point) {
+		tags[label] = value
+	}
+	tags["instance"] = point.Instance
+	// existing measurements have integer fields, floats are only sent when enabled and then for every point
+	// as the type of a field cannot change within a measurement
+	fields := make(map[string]interface{})
+	if backend.InfluxFloats {
+		fields["Value"] = point.Value
+	} else {
+		fields["Value"] = int64(math.Round(point.Value))
+	}
+	return influxclient.NewPoint(key, tags, fields, time.Unix(point.Timestamp, 0))
+}
+
+// tsdbTags converts the dimensions of a point to opentsdb tags.
+// Labels don't override the host (vcenter), object type and instance tags, the host label (esxi of a virtual machine)
+// is sent as esxi unless it is renamed.
+func (backend *Backend) tsdbTags(point Point) opentsdb.Tags {
+	tags := opentsdb.Tags{}
+	for label, value := range backend.labels(point) {
+		if label == "host" {
+			label = "esxi"
+		}
+		if len(value) > 0 {
+			tags[tsdbTag(label)] = tsdbTag(value)
+		}
+	}
+	tags["host"] = point.VCenter
+	tags[point.ObjectType] = backend.objectName(point)
+	for label, value := range backend.identifiers(point) {
+		tags[label] = tsdbTag(value)
+	}
+	if len(point.Instance) > 0 {
+		tags["instance"] = tsdbTag(strings.ToLower(strings.Replace(point.Instance, ".", "_", -1)))
+	}
+	return tags
+}
+
+// Dump writes the points to a writer in the given format (json, graphite or influx) instead of sending them
+func (backend *Backend) Dump(w io.Writer, format string, metrics []Point) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		for _, point := range metrics {
+			if err := encoder.Encode(point); err != nil {
+				return err
+			}
+		}
+	case "graphite":
+		for _, point := range metrics {
+			if _, err := fmt.Fprintf(w, "%s %s %d\n", backend.graphiteKey(point), formatValue(point), point.Timestamp); err != nil {
+				return err
+			}
+		}
+	case "influx":
+		for _, point := range metrics {
+			pt, err := backend.influxPoint(point)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintln(w, pt.String()); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("Format " + format + " unknown.")
+	}
+	return nil
+}
+
+func (backend *Backend) SendNetrics2tsdb(ctx context.Context, values opentsdb.DataPoints, url string) (error) {
 	var buffer bytes.Buffer
 
 	client := &http.Client{
@@ -301,6 +535,7 @@ func (backend *Backend) SendNetrics2tsdb(values opentsdb.DataPoints, url string)
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("Content-Encoding", "gzip")
@@ -312,10 +547,19 @@ func (backend *Backend) SendNetrics2tsdb(values opentsdb.DataPoints, url string)
 
 	defer resp.Body.Close()
 
-	return nil
+	return checkResponse(resp)
+}
+
+// checkResponse returns an error when the server did not accept the request
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return errors.New("Request failed with status " + resp.Status + ": " + strings.TrimSpace(string(body)))
 }
 
-func (backend *Backend) SendFinder(values []FinderInfo, url string) (error) {
+func (backend *Backend) SendFinder(ctx context.Context, values []FinderInfo, url string) (error) {
 	var buffer bytes.Buffer
 
 	client := &http.Client{
@@ -337,6 +581,7 @@ func (backend *Backend) SendFinder(values []FinderInfo, url string) (error) {
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("Content-Encoding", "gzip")
@@ -348,5 +593,5 @@ func (backend *Backend) SendFinder(values []FinderInfo, url string) (error) {
 
 	defer resp.Body.Close()
 
-	return nil
+	return checkResponse(resp)
 }
@@ -1,16 +1,55 @@
 package config
 
 import (
-        "github.com/whpv/vsphere-graphite/vsphere"
-        "github.com/whpv/vsphere-graphite/backend"
+	"errors"
+	"strings"
+
+	"github.com/whpv/vsphere-graphite/backend"
+	"github.com/whpv/vsphere-graphite/vsphere"
 )
 
 // Configuration
 type Configuration struct {
-	Debug    bool
-	VCenters []*vsphere.VCenter
-	Metrics  []vsphere.Metric
-	Interval int
-	Domain   string
-        Backend  backend.Backend
+	Debug           bool
+	VCenters        []*vsphere.VCenter
+	Metrics         []vsphere.Metric
+	Interval        int
+	Domain          string
+	Backend         backend.Backend
+	HTTPListen      string
+	ReadyIntervals  int
+	QueryTimeout    int
+	QueueCycles     bool
+	ShutdownTimeout int
+	StateFile       string
+}
+
+// Validate checks that the configuration can be used
+func (config *Configuration) Validate() error {
+	if config.Interval <= 0 {
+		return errors.New("Interval must be a positive number of seconds")
+	}
+	if len(config.VCenters) == 0 {
+		return errors.New("No vcenter configured")
+	}
+	for _, vcenter := range config.VCenters {
+		if len(vcenter.Hostname) == 0 {
+			return errors.New("A vcenter has no hostname")
+		}
+	}
+	for _, metric := range config.Metrics {
+		err := metric.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if len(config.Backend.Type) == 0 {
+		return errors.New("No backend type configured")
+	}
+	switch strings.ToLower(config.Backend.Naming) {
+	case "", "name", "moref", "uuid":
+	default:
+		return errors.New("Unknown backend naming: " + config.Backend.Naming + ", use name, moref or uuid")
+	}
+	return nil
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/whpv/vsphere-graphite/stats"
+)
+
+// Health of the collector as seen by the http probes
+type Health struct {
+	sync.Mutex
+	interval       int
+	readyIntervals int
+	vcenters       []string
+	lastTick       time.Time
+	lastSend       time.Time
+	sendError      string
+}
+
+// ComponentStatus is the status of a vcenter or of the backend
+type ComponentStatus struct {
+	Status string
+	Last   int64  `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// HealthStatus is the json document returned by the probes
+type HealthStatus struct {
+	Status   string
+	VCenters map[string]ComponentStatus `json:",omitempty"`
+	Backend  *ComponentStatus           `json:",omitempty"`
+}
+
+var health = &Health{}
+
+// Configure updates the interval, readiness window and vcenters watched
+func (h *Health) Configure(interval int, readyIntervals int, vcenters []string) {
+	h.Lock()
+	defer h.Unlock()
+	if readyIntervals <= 0 {
+		readyIntervals = 3
+	}
+	h.interval = interval
+	h.readyIntervals = readyIntervals
+	h.vcenters = vcenters
+}
+
+// Tick records that the main loop is running
+func (h *Health) Tick() {
+	h.Lock()
+	defer h.Unlock()
+	h.lastTick = time.Now()
+}
+
+// Sent records the result of the last send to the backend
+func (h *Health) Sent(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastSend = time.Now()
+	if err != nil {
+		h.sendError = err.Error()
+	} else {
+		h.sendError = ""
+	}
+}
+
+// window returns how long a component can stay silent (lock must be held)
+func (h *Health) window(intervals int) time.Duration {
+	return time.Duration(h.interval*intervals) * time.Second
+}
+
+// Healthz answers ok while the main loop is ticking
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	status := HealthStatus{Status: "ok"}
+	if time.Since(h.lastTick) > h.window(3) {
+		status.Status = "main loop stalled"
+	}
+	h.Unlock()
+	writeHealth(w, status)
+}
+
+// Readyz answers ok when every vcenter was collected recently and the backend accepted the last send
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	window := h.window(h.readyIntervals)
+	status := HealthStatus{Status: "ok", VCenters: map[string]ComponentStatus{}}
+	for _, vcenter := range h.vcenters {
+		vcstatus := ComponentStatus{Status: "ok"}
+		last, ok := stats.Get(vcenter, "query.last")
+		if ok {
+			vcstatus.Last = last
+		}
+		if !ok || time.Since(time.Unix(last, 0)) > window {
+			vcstatus.Status = "no recent collection"
+			status.Status = "not ready"
+		}
+		status.VCenters[vcenter] = vcstatus
+	}
+	backendstatus := ComponentStatus{Status: "ok", Error: h.sendError}
+	if h.lastSend.IsZero() {
+		backendstatus.Status = "nothing sent"
+		status.Status = "not ready"
+	} else {
+		backendstatus.Last = h.lastSend.Unix()
+		if len(h.sendError) > 0 {
+			backendstatus.Status = "last send failed"
+			status.Status = "not ready"
+		}
+	}
+	status.Backend = &backendstatus
+	h.Unlock()
+	writeHealth(w, status)
+}
+
+// writeHealth writes the status as json with a 503 code if not ok
+func writeHealth(w http.ResponseWriter, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,61 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// internal statistics of the collector per source (vcenter hostname or backend type)
+var (
+	lock   sync.Mutex
+	values = map[string]map[string]int64{}
+)
+
+// Set a statistic to a value
+func Set(source string, name string, value int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := values[source]; !ok {
+		values[source] = map[string]int64{}
+	}
+	values[source][name] = value
+}
+
+// Add a delta to a statistic
+func Add(source string, name string, delta int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := values[source]; !ok {
+		values[source] = map[string]int64{}
+	}
+	values[source][name] += delta
+}
+
+// Get the value of a statistic
+func Get(source string, name string) (int64, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	value, ok := values[source][name]
+	return value, ok
+}
+
+// Snapshot returns a copy of all the statistics
+func Snapshot() map[string]map[string]int64 {
+	lock.Lock()
+	defer lock.Unlock()
+	snapshot := make(map[string]map[string]int64, len(values))
+	for source, stats := range values {
+		snapshot[source] = make(map[string]int64, len(stats))
+		for name, value := range stats {
+			snapshot[source][name] = value
+		}
+	}
+	return snapshot
+}
+
+// Handler serves the statistics as json
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Snapshot())
+}
@@ -2,10 +2,11 @@ package utils
 
 import (
 	"math"
-) 
+	"sort"
+)
 
-func Min(n ...int64) int64 {
-	var min int64 = -1
+func Min(n ...float64) float64 {
+	var min float64 = -1
 	for _, i := range n {
 		if i >= 0 {
 			if min == -1 {
@@ -20,8 +21,8 @@ func Min(n ...int64) int64 {
 	return min
 }
 
-func Max(n ...int64) int64 {
-	var max int64 = -1
+func Max(n ...float64) float64 {
+	var max float64 = -1
 	for _, i := range n {
 		if i >= 0 {
 			if max == -1 {
@@ -36,25 +37,98 @@ func Max(n ...int64) int64 {
 	return max
 }
 
-func Sum(n ...int64) int64 {
-	var total int64 = 0
+func Sum(n ...float64) float64 {
+	var total float64 = -1
 	for _, i := range n {
-		if i > 0 {
-			total += i
+		if i >= 0 {
+			if total == -1 {
+				total = i
+			} else {
+				total += i
+			}
 		}
 	}
 	return total
 }
 
-func Average(n ...int64) int64 {
-	var total int64 = 0
-	var count int64 = 0
+func Average(n ...float64) float64 {
+	var total float64 = 0
+	var count float64 = 0
+	for _, i := range n {
+		if i >= 0 {
+			count += 1
+			total += i
+		}
+	}
+	if count == 0 {
+		return -1
+	}
+	return total / count
+}
+
+func Last(n ...float64) float64 {
+	for i := len(n) - 1; i >= 0; i-- {
+		if n[i] >= 0 {
+			return n[i]
+		}
+	}
+	return -1
+}
+
+func Count(n ...float64) float64 {
+	var count float64 = 0
+	for _, i := range n {
+		if i >= 0 {
+			count += 1
+		}
+	}
+	if count == 0 {
+		return -1
+	}
+	return count
+}
+
+func Percentile(p float64, n ...float64) float64 {
+	values := []float64{}
+	for _, i := range n {
+		if i >= 0 {
+			values = append(values, i)
+		}
+	}
+	if len(values) == 0 {
+		return -1
+	}
+	sort.Float64s(values)
+	// nearest rank
+	rank := int(math.Ceil(p / 100 * float64(len(values))))
+	if rank < 1 {
+		rank = 1
+	}
+	return values[rank-1]
+}
+
+func P95(n ...float64) float64 {
+	return Percentile(95, n...)
+}
+
+func StdDev(n ...float64) float64 {
+	var total float64 = 0
+	var count float64 = 0
 	for _, i := range n {
 		if i >= 0 {
 			count += 1
 			total += i
 		}
 	}
-	favg := float64(total) / float64(count)
-	return int64(math.Floor(favg + .5))
+	if count == 0 {
+		return -1
+	}
+	mean := total / count
+	var variance float64 = 0
+	for _, i := range n {
+		if i >= 0 {
+			variance += (i - mean) * (i - mean)
+		}
+	}
+	return math.Sqrt(variance / count)
 }
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFunctions(t *testing.T) {
+	tests := []struct {
+		name     string
+		function func(...float64) float64
+		values   []float64
+		want     float64
+	}{
+		{"min", Min, []float64{3, 1, 2}, 1},
+		{"min sentinel", Min, []float64{-1, 3, -1, 2}, 2},
+		{"min empty", Min, nil, -1},
+		{"min only sentinels", Min, []float64{-1, -1}, -1},
+		{"max", Max, []float64{3, 1, 2}, 3},
+		{"max sentinel", Max, []float64{-1, 3, -1}, 3},
+		{"max empty", Max, nil, -1},
+		{"sum", Sum, []float64{3, 1, 2}, 6},
+		{"sum zeros", Sum, []float64{0, 0}, 0},
+		{"sum sentinel", Sum, []float64{-1, 3, -1, 2}, 5},
+		{"sum empty", Sum, nil, -1},
+		{"sum only sentinels", Sum, []float64{-1}, -1},
+		{"average", Average, []float64{1, 2}, 1.5},
+		{"average sentinel", Average, []float64{-1, 1, 2, -1}, 1.5},
+		{"average empty", Average, nil, -1},
+		{"last", Last, []float64{1, 2, 3}, 3},
+		{"last sentinel", Last, []float64{1, 2, -1}, 2},
+		{"last empty", Last, nil, -1},
+		{"last only sentinels", Last, []float64{-1, -1}, -1},
+		{"count", Count, []float64{0, 1, 2}, 3},
+		{"count sentinel", Count, []float64{-1, 1, -1}, 1},
+		{"count empty", Count, nil, -1},
+		{"count only sentinels", Count, []float64{-1, -1}, -1},
+		{"p95 single", P95, []float64{7}, 7},
+		{"p95 sentinel", P95, []float64{-1, 7, -1}, 7},
+		{"p95 empty", P95, nil, -1},
+		{"stddev", StdDev, []float64{2, 4, 4, 4, 5, 5, 7, 9}, 2},
+		{"stddev constant", StdDev, []float64{3, 3, 3}, 0},
+		{"stddev sentinel", StdDev, []float64{-1, 2, 4, 4, 4, 5, 5, 7, 9, -1}, 2},
+		{"stddev empty", StdDev, nil, -1},
+	}
+	for _, test := range tests {
+		if got := test.function(test.values...); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s(%v) = %v, want %v", test.name, test.values, got, test.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	// 1 to 20, unordered
+	values := []float64{20, 1, 19, 2, 18, 3, 17, 4, 16, 5, 15, 6, 14, 7, 13, 8, 12, 9, 11, 10}
+	tests := []struct {
+		p      float64
+		values []float64
+		want   float64
+	}{
+		// nearest rank: the ceil(p/100*n)th smallest value
+		{95, values, 19},
+		{50, values, 10},
+		{100, values, 20},
+		{0, values, 1},
+		{95, []float64{1, 2, 3, 4}, 4},
+		{50, []float64{1, 2, 3, 4}, 2},
+		{95, append([]float64{-1, -1}, values...), 19},
+		{95, []float64{}, -1},
+	}
+	for _, test := range tests {
+		if got := Percentile(test.p, test.values...); got != test.want {
+			t.Errorf("Percentile(%v, %v) = %v, want %v", test.p, test.values, got, test.want)
+		}
+	}
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"runtime"
@@ -18,10 +25,13 @@ import (
 
 	"github.com/whpv/vsphere-graphite/backend"
 	"github.com/whpv/vsphere-graphite/config"
+	"github.com/whpv/vsphere-graphite/stats"
 	"github.com/whpv/vsphere-graphite/vsphere"
 
 	"github.com/takama/daemon"
 
+	"golang.org/x/net/context"
+
 	"github.com/vmware/govmomi/vim25/types"
 	"github.com/vmware/govmomi/vim25/debug"
 
@@ -50,18 +60,109 @@ type EntityQuery struct {
 	Metrics []int
 }
 
-func queryVCenter(vcenter vsphere.VCenter, config config.Configuration, channel *chan []backend.Point) {
-	vcenter.Query(config.Interval, config.Domain, channel)
+// Cycles tracks the running collection of each vcenter so that cycles don't overlap
+type Cycles struct {
+	sync.Mutex
+	running map[string]bool
+	queued  map[string]bool
+}
+
+var cycles = &Cycles{running: map[string]bool{}, queued: map[string]bool{}}
+
+// Start marks a collection as running for a vcenter.
+// If one is already running, the cycle is queued (once) or skipped and false is returned.
+func (c *Cycles) Start(hostname string, queue bool) bool {
+	c.Lock()
+	defer c.Unlock()
+	if !c.running[hostname] {
+		c.running[hostname] = true
+		return true
+	}
+	if queue && !c.queued[hostname] {
+		c.queued[hostname] = true
+		stdlog.Println("Previous collection of vcenter " + hostname + " still running, queuing cycle")
+		stats.Add(hostname, "query.queued", 1)
+		return false
+	}
+	errlog.Println("Previous collection of vcenter " + hostname + " still running, skipping cycle")
+	stats.Add(hostname, "query.skipped", 1)
+	return false
+}
+
+// Done marks the collection of a vcenter as finished.
+// It returns true if a queued cycle must run now (the vcenter is kept as running).
+func (c *Cycles) Done(hostname string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.queued[hostname] {
+		c.queued[hostname] = false
+		return true
+	}
+	c.running[hostname] = false
+	return false
+}
+
+// untilNextInterval returns the duration until the next wall clock multiple of the interval
+func untilNextInterval(interval int) time.Duration {
+	period := time.Duration(interval) * time.Second
+	now := time.Now()
+	return now.Truncate(period).Add(period).Sub(now)
+}
+
+// running collections, waited for at shutdown
+var running sync.WaitGroup
+
+// stopping is closed at shutdown: collections that haven't started don't start anymore
+var stopping = make(chan struct{})
+
+// stopped tells if the shutdown started
+func stopped() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+func queryVCenter(ctx context.Context, vcenter *vsphere.VCenter, config config.Configuration, channel *chan []backend.Point) {
+	defer running.Done()
+	if delay := vcenter.Delay(); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-stopping:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+	if stopped() || !cycles.Start(vcenter.Hostname, config.QueueCycles) {
+		return
+	}
+	timeout := config.QueryTimeout
+	if timeout <= 0 {
+		timeout = config.Interval
+	}
+	for {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		vcenter.Query(ctx, config.Interval, config.Domain, channel)
+		cancel()
+		// queued cycles are dropped at shutdown
+		if !cycles.Done(vcenter.Hostname) || stopped() {
+			return
+		}
+	}
 }
 
-func queryFinder(vcenter vsphere.VCenter, channel *chan backend.FinderStuct) {
-	vcenter.QueryFinder(channel)
+func queryFinder(ctx context.Context, vcenter vsphere.VCenter, channel *chan backend.FinderStuct) {
+	defer running.Done()
+	vcenter.QueryFinder(ctx, channel)
 }
 
 // Manage by daemon commands or run the daemon
 func (service *Service) Manage() (string, error) {
 	//defer saveHeapProfile()
-	usage := "Usage: myservice install | remove | start | stop | status"
+	usage := "Usage: myservice install | remove | start | stop | status | check | counters [-vcenter hostname] [-entity Type:value] [-format table|json] | once [-format json|graphite|influx]"
 
 	// if received any kind of command, do it
 	if len(os.Args) > 1 {
@@ -77,6 +178,12 @@ func (service *Service) Manage() (string, error) {
 			return service.Stop()
 		case "status":
 			return service.Status()
+		case "check":
+			return check()
+		case "counters":
+			return counters(os.Args[2:])
+		case "once":
+			return once(os.Args[2:])
 		default:
 			return usage, nil
 		}
@@ -85,16 +192,12 @@ func (service *Service) Manage() (string, error) {
 	stdlog.Println("Starting daemon:", path.Base(os.Args[0]))
 
 	// read the configuration
-	file, err := os.Open("/etc/" + path.Base(os.Args[0]) + ".json")
+	configFile = "/etc/" + path.Base(os.Args[0]) + ".json"
+	config, err := loadConfig(configFile)
 	if err != nil {
-		return "Could not open configuration file", err
-	}
-	jsondec := json.NewDecoder(file)
-	config := config.Configuration{}
-	err = jsondec.Decode(&config)
-	if err != nil {
-		return "Could not decode configuration file", err
+		return "Could not load configuration file", err
 	}
+	vsphere.Debug = config.Debug
 
 	if config.Debug {
 		newpath := filepath.Join(".", "debug_log")
@@ -107,86 +210,122 @@ func (service *Service) Manage() (string, error) {
 		defer debug.Flush()
 	}
 
-	//force backend values to environement varialbles if present
-	s := reflect.ValueOf(&config.Backend).Elem()
-	numfields := s.NumField()
-	for i := 0; i < numfields; i++ {
-		f := s.Field(i)
-		if f.CanSet() {
-			//exported field
-			envname := strings.ToUpper(s.Type().Name() + "_" + s.Type().Field(i).Name)
-			envval := os.Getenv(envname)
-			if len(envval) > 0 {
-				//environment variable set with name
-				switch ftype := f.Type().Name(); ftype {
-				case "string":
-					f.SetString(envval)
-				case "int":
-					val, err := strconv.ParseInt(envval, 10, 64)
-					if err == nil {
-						f.SetInt(val)
-					}
-				}
-			}
-		}
-	}
-
 	for _, vcenter := range config.VCenters {
 		vcenter.Init(config.Metrics, stdlog, errlog)
 	}
 
+	if len(config.StateFile) > 0 {
+		err = vsphere.LoadState(config.StateFile)
+		if err != nil {
+			return "Could not load state file", err
+		}
+	}
+
 	err = config.Backend.Init(stdlog, errlog)
 	if err != nil {
 		return "Could not initialize backend", err
 	}
-	defer config.Backend.Disconnect()
+	defer func() { config.Backend.Disconnect() }()
+
+	health.Configure(config.Interval, config.ReadyIntervals, vcenterNames(config))
+	health.Tick()
+	if len(config.HTTPListen) > 0 {
+		go serveHTTP(config.HTTPListen)
+	}
 
 	// Set up channel on which to send signal notifications.
 	// We must use a buffered channel or risk missing the signal
 	// if we're not ready to receive when the signal is sent.
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
+	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Set up a channel to recieve the metrics
 	metrics := make(chan []backend.Point)
 	finders := make(chan backend.FinderStuct)
 
-	// Set up a ticker to collect metrics at givent interval
-	ticker := time.NewTicker(time.Second * time.Duration(config.Interval))
-	defer ticker.Stop()
+	// Set up a channel to receive the reloaded configuration
+	reloads := make(chan reloaded, 1)
+	reloading := false
+
+	// Root context of the collections, cancelled at shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Set up a timer to collect metrics at givent interval, aligned on the wall clock
+	timer := time.NewTimer(untilNextInterval(config.Interval))
+	defer func() { timer.Stop() }()
 
 	tickerFinder := time.NewTicker(time.Second * time.Duration(config.Interval) * 20)
-	defer tickerFinder.Stop()
+	defer func() { tickerFinder.Stop() }()
 
 	// Start retriveing and sending metrics
 	stdlog.Println("Retrieving metrics")
 	for _, vcenter := range config.VCenters {
-		go queryVCenter(*vcenter, config, &metrics)
-		go queryFinder(*vcenter, &finders)
+		running.Add(2)
+		go queryVCenter(ctx, vcenter, *config, &metrics)
+		go queryFinder(ctx, *vcenter, &finders)
 
 	}
 	for {
 		select {
 		case values := <-metrics:
-			config.Backend.SendMetrics(values)
-			stdlog.Printf("Sent %d metrics to backend", len(values))
+			sendMetrics(ctx, config, values)
 		case values := <-finders:
-
-			url := fmt.Sprintf("%s?api_key=%s&host=%s", config.Backend.FinderUrl, config.Backend.ApiKey, values.Host)
-			config.Backend.SendFinder(values.Infos, url)
-			stdlog.Printf("Sent %d finder info to backend", len(values.Infos))
-		case <-ticker.C:
+			sendFinder(ctx, config, values)
+		case <-timer.C:
+			timer.Reset(untilNextInterval(config.Interval))
+			health.Tick()
 			stdlog.Println("Retrieving metrics")
 			for _, vcenter := range config.VCenters {
-				go queryVCenter(*vcenter, config, &metrics)
+				running.Add(1)
+				go queryVCenter(ctx, vcenter, *config, &metrics)
 			}
+			sendMetrics(ctx, config, collectorPoints(config.Domain, time.Now().Unix()))
 		case <-tickerFinder.C:
 			stdlog.Println("Retrieving metrics")
 			for _, vcenter := range config.VCenters {
-				go queryFinder(*vcenter, &finders)
+				running.Add(1)
+				go queryFinder(ctx, *vcenter, &finders)
 			}
+		case reload := <-reloads:
+			reloading = false
+			if reload.err != nil {
+				errlog.Println("Could not reload configuration, keeping the current one")
+				errlog.Println("Error: ", reload.err)
+				continue
+			}
+			newconfig := reload.config
+			if newconfig.Interval != config.Interval {
+				timer.Stop()
+				tickerFinder.Stop()
+				timer = time.NewTimer(untilNextInterval(newconfig.Interval))
+				tickerFinder = time.NewTicker(time.Second * time.Duration(newconfig.Interval) * 20)
+			}
+			if !newconfig.Backend.Equals(&config.Backend) {
+				config.Backend.Disconnect()
+			}
+			config = newconfig
+			health.Configure(config.Interval, config.ReadyIntervals, vcenterNames(config))
+			stdlog.Println("Configuration reloaded")
 		case killSignal := <-interrupt:
 			stdlog.Println("Got signal:", killSignal)
+			if killSignal == syscall.SIGHUP {
+				if reloading {
+					errlog.Println("Configuration reload already in progress")
+					continue
+				}
+				// vcenters and backend are initialized beside the collections
+				reloading = true
+				current := config
+				go func() {
+					newconfig, err := reloadConfig(current)
+					reloads <- reloaded{newconfig, err}
+				}()
+				continue
+			}
+			timer.Stop()
+			tickerFinder.Stop()
+			shutdown(cancel, config, metrics, finders, interrupt)
 			if killSignal == os.Interrupt {
 				return "Daemon was interruped by system signal", nil
 			}
@@ -198,13 +337,429 @@ func (service *Service) Manage() (string, error) {
 	return usage, nil
 }
 
+// collections get this long to return once cancelled before the shutdown gives up on them
+const cancelTimeout = 5 * time.Second
+
+// shutdown lets the running collections finish and sends their batches to the backend,
+// collections still waiting for their offset don't start.
+// Collections still running at the shutdown deadline are cancelled, and abandoned if they don't return shortly after.
+// Another termination signal stops waiting at once.
+func shutdown(cancel context.CancelFunc, config *config.Configuration, metrics chan []backend.Point, finders chan backend.FinderStuct, interrupt chan os.Signal) {
+	close(stopping)
+	timeout := config.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 10
+	}
+	stdlog.Printf("Waiting up to %d seconds for running collections", timeout)
+	ctx, cancelSend := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancelSend()
+
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	deadline := ctx.Done()
+	var abandon <-chan time.Time
+	for {
+		select {
+		case values := <-metrics:
+			sendMetrics(ctx, config, values)
+		case values := <-finders:
+			sendFinder(ctx, config, values)
+		case <-done:
+			stdlog.Println("All collections finished")
+			return
+		case <-deadline:
+			errlog.Println("Shutdown deadline reached, cancelling running collections")
+			cancel()
+			deadline = nil
+			abandon = time.After(cancelTimeout)
+		case <-abandon:
+			errlog.Println("Running collections did not return after being cancelled, exiting anyway")
+			return
+		case killSignal := <-interrupt:
+			if killSignal == syscall.SIGHUP {
+				stdlog.Println("Ignoring configuration reload during shutdown")
+				continue
+			}
+			errlog.Println("Got signal:", killSignal, "during shutdown, exiting without waiting for running collections")
+			cancel()
+			return
+		}
+	}
+}
+
+// sendFinder sends the finder informations to the backend
+func sendFinder(ctx context.Context, config *config.Configuration, values backend.FinderStuct) {
+	url := fmt.Sprintf("%s?api_key=%s&host=%s", config.Backend.FinderUrl, config.Backend.ApiKey, values.Host)
+	err := config.Backend.SendFinder(ctx, values.Infos, url)
+	if err != nil {
+		errlog.Println("Error sending finder info: ", err)
+		stats.Add("backend", "finder.errors", 1)
+		return
+	}
+	stdlog.Printf("Sent %d finder info to backend", len(values.Infos))
+}
+
+// sendMetrics sends the points to the backend and keeps track of the sending statistics
+func sendMetrics(ctx context.Context, config *config.Configuration, values []backend.Point) {
+	start := time.Now()
+	err := config.Backend.SendMetrics(ctx, values)
+	health.Sent(err)
+	stats.Set("backend", "send.duration", int64(time.Since(start)/time.Millisecond))
+	if err != nil {
+		stats.Add("backend", "send.errors", 1)
+		return
+	}
+	stats.Set("backend", "send.points", int64(len(values)))
+	stats.Set("backend", "send.last", time.Now().Unix())
+	err = vsphere.Commit(values)
+	if err != nil {
+		errlog.Println("Could not save state file")
+		errlog.Println("Error: ", err)
+	}
+	stdlog.Printf("Sent %d metrics to backend", len(values))
+}
+
+// vcenterNames lists the hostnames of the configured vcenters
+func vcenterNames(config *config.Configuration) []string {
+	names := []string{}
+	for _, vcenter := range config.VCenters {
+		names = append(names, vcenter.Hostname)
+	}
+	return names
+}
+
+// collectorPoints converts the collector statistics to points
+func collectorPoints(domain string, timestamp int64) []backend.Point {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = name
+	}
+	hostname = strings.Replace(strings.Replace(hostname, domain, "", -1), ".", "_", -1)
+	points := []backend.Point{}
+	for source, values := range stats.Snapshot() {
+		source = strings.Replace(source, domain, "", -1)
+		for stat, value := range values {
+			parts := strings.SplitN(stat, ".", 2)
+			points = append(points, backend.Point{
+				VCenter:    source,
+				ObjectType: "collector",
+				ObjectName: hostname,
+				Group:      parts[0],
+				Counter:    parts[1],
+				Rollup:     "latest",
+				Value:      float64(value),
+				Timestamp:  timestamp,
+			})
+		}
+	}
+	return points
+}
+
+// serveHTTP exposes the collector statistics
+func serveHTTP(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", stats.Handler)
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+	stdlog.Println("Listening for http requests on " + address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		errlog.Println("Could not listen for http requests on " + address)
+		errlog.Println("Error: ", err)
+	}
+}
+
 var (
-	pid      int
-	progname string
+	pid        int
+	progname   string
+	configFile string
 )
 
+// check validates the configuration against the vcenters and the backend
+func check() (string, error) {
+	configFile = "/etc/" + path.Base(os.Args[0]) + ".json"
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return "Could not load configuration file", err
+	}
+	vsphere.Debug = config.Debug
+	problems := 0
+	for _, vcenter := range config.VCenters {
+		missing, err := vcenter.Check(config.Metrics, stdlog, errlog)
+		if err != nil {
+			errlog.Println("Could not check vcenter " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			problems++
+			continue
+		}
+		for _, metric := range missing {
+			errlog.Println("Metric " + metric + " not found in vcenter " + vcenter.Hostname)
+			problems++
+		}
+		if len(missing) == 0 {
+			stdlog.Println("Vcenter " + vcenter.Hostname + " knows all configured metrics")
+		}
+	}
+	err = config.Backend.Check()
+	if err != nil {
+		errlog.Println("Could not reach backend " + config.Backend.Type)
+		errlog.Println("Error: ", err)
+		problems++
+	} else {
+		stdlog.Println("Backend " + config.Backend.Type + " is reachable")
+	}
+	if problems > 0 {
+		return "Configuration check failed", fmt.Errorf("%d problem(s) found", problems)
+	}
+	return "Configuration check succeeded", nil
+}
+
+// counters lists the performance counters of a vcenter from the configuration
+func counters(args []string) (string, error) {
+	flags := flag.NewFlagSet("counters", flag.ContinueOnError)
+	hostname := flags.String("vcenter", "", "vcenter to query (first configured vcenter per default)")
+	entity := flags.String("entity", "", "only list counters available for this entity (i.e.: VirtualMachine:vm-42)")
+	format := flags.String("format", "table", "output format: table or json")
+	err := flags.Parse(args)
+	if err != nil {
+		return "Could not parse arguments", err
+	}
+
+	// keep stdout for the listing
+	stdlog = log.New(os.Stderr, "", log.Ldate|log.Ltime)
+
+	configFile = "/etc/" + path.Base(os.Args[0]) + ".json"
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return "Could not load configuration file", err
+	}
+	vsphere.Debug = config.Debug
+	vcenter := config.VCenters[0]
+	if len(*hostname) > 0 {
+		vcenter = nil
+		for _, vc := range config.VCenters {
+			if vc.Hostname == *hostname {
+				vcenter = vc
+				break
+			}
+		}
+		if vcenter == nil {
+			return "Could not find vcenter", errors.New("Vcenter " + *hostname + " is not in the configuration")
+		}
+	}
+
+	list, err := vcenter.Counters(*entity, stdlog, errlog)
+	if err != nil {
+		return "Could not list counters from vcenter " + vcenter.Hostname, err
+	}
+
+	switch *format {
+	case "json":
+		out, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return "Could not format counters", err
+		}
+		return string(out), nil
+	case "table":
+		var buffer bytes.Buffer
+		w := tabwriter.NewWriter(&buffer, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tMETRIC\tUNIT\tSTATS\tLEVEL\tINSTANCES\tDESCRIPTION")
+		for _, counter := range list {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\n", counter.Key, counter.Metric, counter.Unit, counter.StatsType, counter.Level, strings.Join(counter.Instances, ","), counter.Description)
+		}
+		w.Flush()
+		return buffer.String(), nil
+	default:
+		return "Unknown format", errors.New("Format " + *format + " is not table or json")
+	}
+}
+
+// once collects the metrics of every vcenter a single time and prints them instead of sending them to the backend
+func once(args []string) (string, error) {
+	flags := flag.NewFlagSet("once", flag.ContinueOnError)
+	format := flags.String("format", "json", "output format: json, graphite or influx")
+	err := flags.Parse(args)
+	if err != nil {
+		return "Could not parse arguments", err
+	}
+
+	// keep stdout for the points
+	stdlog = log.New(os.Stderr, "", log.Ldate|log.Ltime)
+
+	configFile = "/etc/" + path.Base(os.Args[0]) + ".json"
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return "Could not load configuration file", err
+	}
+	vsphere.Debug = config.Debug
+
+	metrics := make(chan []backend.Point, len(config.VCenters))
+	var wg sync.WaitGroup
+	for _, vcenter := range config.VCenters {
+		vcenter.Init(config.Metrics, stdlog, errlog)
+		wg.Add(1)
+		go func(vcenter vsphere.VCenter) {
+			defer wg.Done()
+			vcenter.Query(context.Background(), config.Interval, config.Domain, &metrics)
+		}(*vcenter)
+	}
+	wg.Wait()
+	close(metrics)
+
+	count := 0
+	for values := range metrics {
+		err = config.Backend.Dump(os.Stdout, *format, values)
+		if err != nil {
+			return "Could not print metrics", err
+		}
+		count += len(values)
+	}
+	stdlog.Printf("Printed %d metrics", count)
+	return "", nil
+}
+
+// loadConfig reads the configuration file and applies the environment overrides
+func loadConfig(file string) (*config.Configuration, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	jsondec := json.NewDecoder(f)
+	conf := config.Configuration{}
+	err = jsondec.Decode(&conf)
+	if err != nil {
+		return nil, err
+	}
+
+	//force backend values to environement varialbles if present
+	s := reflect.ValueOf(&conf.Backend).Elem()
+	numfields := s.NumField()
+	for i := 0; i < numfields; i++ {
+		f := s.Field(i)
+		if f.CanSet() {
+			//exported field
+			envname := strings.ToUpper(s.Type().Name() + "_" + s.Type().Field(i).Name)
+			envval := os.Getenv(envname)
+			if len(envval) > 0 {
+				//environment variable set with name
+				switch ftype := f.Type().Name(); ftype {
+				case "string":
+					f.SetString(envval)
+				case "int":
+					val, err := strconv.ParseInt(envval, 10, 64)
+					if err == nil {
+						f.SetInt(val)
+					}
+				case "bool":
+					val, err := strconv.ParseBool(envval)
+					if err == nil {
+						f.SetBool(val)
+					}
+				}
+			}
+		}
+	}
+
+	err = conf.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// reloaded is the outcome of a configuration reload
+type reloaded struct {
+	config *config.Configuration
+	err    error
+}
+
+// reloadConfig reads the configuration file again and only reinitializes what changed.
+// It runs beside the collections and only reads the current configuration: the caller swaps
+// the configurations and disconnects the current backend if it changed.
+// The current configuration stays untouched if the new one cannot be used.
+func reloadConfig(current *config.Configuration) (*config.Configuration, error) {
+	stdlog.Println("Reloading configuration from", configFile)
+	conf, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// settings used at startup only
+	if conf.HTTPListen != current.HTTPListen {
+		errlog.Println("HTTPListen changed, restart to apply it")
+		conf.HTTPListen = current.HTTPListen
+	}
+	if conf.StateFile != current.StateFile {
+		errlog.Println("StateFile changed, restart to apply it")
+		conf.StateFile = current.StateFile
+	}
+	if conf.Debug != current.Debug {
+		errlog.Println("Debug changed, restart to apply it")
+		conf.Debug = current.Debug
+	}
+
+	// backend first: a failing backend keeps the current configuration
+	backendChanged := !conf.Backend.Equals(&current.Backend)
+	if !backendChanged {
+		conf.Backend = current.Backend
+	} else {
+		stdlog.Println("Backend configuration changed")
+		err = conf.Backend.Init(stdlog, errlog)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	metricsChanged := !reflect.DeepEqual(conf.Metrics, current.Metrics)
+	if metricsChanged {
+		stdlog.Println("Metrics configuration changed, reinitializing all vcenters")
+	}
+	for i, vcenter := range conf.VCenters {
+		if !metricsChanged {
+			reused := false
+			for _, old := range current.VCenters {
+				if old.Equals(vcenter) {
+					conf.VCenters[i] = old
+					reused = true
+					break
+				}
+			}
+			if reused {
+				continue
+			}
+		}
+		stdlog.Println("Initializing vcenter " + vcenter.Hostname)
+		err = vcenter.Init(conf.Metrics, stdlog, errlog)
+		if err != nil {
+			// a vcenter without metrics would collect nothing until the next reload
+			if backendChanged {
+				conf.Backend.Disconnect()
+			}
+			return nil, errors.New("Could not initialize vcenter " + vcenter.Hostname + ": " + err.Error())
+		}
+	}
+	for _, old := range current.VCenters {
+		removed := true
+		for _, vcenter := range conf.VCenters {
+			if vcenter.Hostname == old.Hostname {
+				removed = false
+				break
+			}
+		}
+		if removed {
+			stdlog.Println("Removed vcenter " + old.Hostname)
+		}
+	}
+	return conf, nil
+}
+
 func init() {
 	pid = os.Getpid()
+	rand.Seed(time.Now().UnixNano())
 	paths := strings.Split(os.Args[0], "/")
 	paths = strings.Split(paths[len(paths)-1], string(os.PathSeparator))
 	progname = paths[len(paths)-1]
@@ -237,5 +792,7 @@ func main() {
 		errlog.Println(status, "\nError: ", err)
 		os.Exit(1)
 	}
-	fmt.Println(status)
+	if len(status) > 0 {
+		fmt.Println(status)
+	}
 }
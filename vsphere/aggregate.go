@@ -0,0 +1,141 @@
+package vsphere
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/whpv/vsphere-graphite/backend"
+	"github.com/whpv/vsphere-graphite/utils"
+)
+
+// aggregateFunctions are the functions collapsing the samples of a series and computing cluster, datacenter and vcenter aggregates.
+// They ignore the -1 values vSphere returns for missing samples and return -1 when there is no sample.
+var aggregateFunctions = map[string]func(...float64) float64{
+	"avg":    utils.Average,
+	"max":    utils.Max,
+	"min":    utils.Min,
+	"sum":    utils.Sum,
+	"last":   utils.Last,
+	"p95":    utils.P95,
+	"count":  utils.Count,
+	"stddev": utils.StdDev,
+}
+
+// floatFunctions are the functions whose result is not an integer when the values are
+var floatFunctions = map[string]bool{
+	"avg":    true,
+	"stddev": true,
+}
+
+// rollupFunctions are the default functions collapsing series by counter rollup
+var rollupFunctions = map[string]string{
+	"average":   "avg",
+	"maximum":   "max",
+	"minimum":   "min",
+	"summation": "sum",
+	"latest":    "last",
+	"none":      "last",
+}
+
+// validateAggregates checks the function and the aggregation functions of a metric definition
+func validateAggregates(metricdef MetricDef) error {
+	for _, function := range append([]string{metricdef.Function}, metricdef.Aggregate...) {
+		if _, ok := aggregateFunctions[strings.ToLower(function)]; len(function) > 0 && !ok {
+			return errors.New("Unknown function " + function + " of metric " + metricdef.Metric + ", use avg, max, min, sum, last, p95, count or stddev")
+		}
+	}
+	return nil
+}
+
+// seriesFunction returns the name of the function collapsing the samples of a metric: its function or the default of its rollup
+func seriesFunction(metricdef MetricDef) string {
+	if len(metricdef.Function) > 0 {
+		return strings.ToLower(metricdef.Function)
+	}
+	parts := strings.Split(metricdef.Metric, ".")
+	return rollupFunctions[strings.ToLower(parts[len(parts)-1])]
+}
+
+// aggregateKey identifies the points aggregated together
+type aggregateKey struct {
+	objectType string
+	objectName string
+	datacenter string
+	source     string
+	group      string
+	counter    string
+	rollup     string
+	timestamp  int64
+}
+
+// aggregate computes the cluster, datacenter and vcenter aggregates of the points.
+// Functions are the aggregation functions by object type and metric, only points without instance are aggregated.
+// The aggregated object type is the instance of the aggregate and the function is appended to the rollup,
+// i.e.: the sum of the cpu.usagemhz.average of the hosts of a cluster is cluster.<name>.cpu.usagemhz.average_sum.hostsystem
+// Aggregates cover the longest span of their points.
+func aggregate(points []backend.Point, functions map[string][]string) []backend.Point {
+	if len(functions) == 0 {
+		return nil
+	}
+	values := make(map[aggregateKey][]float64)
+	float := make(map[aggregateKey]bool)
+	spans := make(map[aggregateKey]time.Duration)
+	keys := []aggregateKey{}
+	add := func(key aggregateKey, point backend.Point) {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = append(values[key], point.Value)
+		float[key] = float[key] || point.Float
+		if point.Span > spans[key] {
+			spans[key] = point.Span
+		}
+	}
+	for _, point := range points {
+		if len(point.Instance) > 0 || point.Value < 0 {
+			continue
+		}
+		if _, ok := functions[point.ObjectType+"."+point.Group+"."+point.Counter+"."+point.Rollup]; !ok {
+			continue
+		}
+		key := aggregateKey{source: point.ObjectType, group: point.Group, counter: point.Counter, rollup: point.Rollup, timestamp: point.Timestamp}
+		datacenter := point.Labels["datacenter"]
+		if cluster, ok := point.Labels["cluster"]; ok {
+			key.objectType, key.objectName, key.datacenter = "cluster", cluster, datacenter
+			add(key, point)
+		}
+		if len(datacenter) > 0 {
+			key.objectType, key.objectName, key.datacenter = "datacenter", datacenter, ""
+			add(key, point)
+		}
+		key.objectType, key.objectName, key.datacenter = "vcenter", point.VCenter, ""
+		add(key, point)
+	}
+
+	aggregates := []backend.Point{}
+	for _, key := range keys {
+		labels := map[string]string{}
+		if len(key.datacenter) > 0 {
+			labels["datacenter"] = key.datacenter
+		}
+		for _, function := range functions[key.source+"."+key.group+"."+key.counter+"."+key.rollup] {
+			function = strings.ToLower(function)
+			aggregates = append(aggregates, backend.Point{
+				VCenter:    points[0].VCenter,
+				ObjectType: key.objectType,
+				ObjectName: strings.ToLower(strings.Replace(key.objectName, ".", "_", -1)),
+				Group:      key.group,
+				Counter:    key.counter,
+				Instance:   key.source,
+				Rollup:     key.rollup + "_" + function,
+				Value:      aggregateFunctions[function](values[key]...),
+				Float:      float[key] || floatFunctions[function],
+				Labels:     labels,
+				Span:       spans[key],
+				Timestamp:  key.timestamp,
+			})
+		}
+	}
+	return aggregates
+}
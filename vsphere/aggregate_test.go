@@ -0,0 +1,125 @@
+package vsphere
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/whpv/vsphere-graphite/backend"
+)
+
+func TestAggregate(t *testing.T) {
+	host := func(name, cluster string, value float64) backend.Point {
+		labels := map[string]string{"datacenter": "dc1"}
+		if len(cluster) > 0 {
+			labels["cluster"] = cluster
+		}
+		return backend.Point{VCenter: "vc", ObjectType: "hostsystem", ObjectName: name, Group: "cpu", Counter: "usagemhz", Rollup: "average",
+			Value: value, Labels: labels, Span: 20 * time.Second, Timestamp: 100}
+	}
+	points := []backend.Point{
+		host("esx1", "cl.1", 100),
+		host("esx2", "cl.1", 300),
+		host("esx3", "", 200),
+		host("esx4", "cl.1", -1),
+		{VCenter: "vc", ObjectType: "hostsystem", ObjectName: "esx1", Group: "cpu", Counter: "usagemhz", Instance: "0", Rollup: "average",
+			Value: 1000, Labels: map[string]string{"cluster": "cl.1", "datacenter": "dc1"}, Timestamp: 100},
+		{VCenter: "vc", ObjectType: "hostsystem", ObjectName: "esx1", Group: "mem", Counter: "usage", Rollup: "average",
+			Value: 50, Labels: map[string]string{"cluster": "cl.1", "datacenter": "dc1"}, Timestamp: 100},
+	}
+	slow := host("esx2", "cl.1", 0)
+	slow.Span = time.Minute
+	slow.Float = true
+	slow.Timestamp = 160
+	points = append(points, slow)
+
+	aggregates := aggregate(points, map[string][]string{"hostsystem.cpu.usagemhz.average": {"sum", "Avg"}})
+	tests := []struct {
+		objectType string
+		objectName string
+		rollup     string
+		timestamp  int64
+		value      float64
+		float      bool
+		span       time.Duration
+		datacenter string
+	}{
+		{"cluster", "cl_1", "average_sum", 100, 400, false, 20 * time.Second, "dc1"},
+		{"cluster", "cl_1", "average_avg", 100, 200, true, 20 * time.Second, "dc1"},
+		{"datacenter", "dc1", "average_sum", 100, 600, false, 20 * time.Second, ""},
+		{"datacenter", "dc1", "average_avg", 100, 200, true, 20 * time.Second, ""},
+		{"vcenter", "vc", "average_sum", 100, 600, false, 20 * time.Second, ""},
+		{"vcenter", "vc", "average_avg", 100, 200, true, 20 * time.Second, ""},
+		{"cluster", "cl_1", "average_sum", 160, 0, true, time.Minute, "dc1"},
+		{"cluster", "cl_1", "average_avg", 160, 0, true, time.Minute, "dc1"},
+		{"datacenter", "dc1", "average_sum", 160, 0, true, time.Minute, ""},
+		{"datacenter", "dc1", "average_avg", 160, 0, true, time.Minute, ""},
+		{"vcenter", "vc", "average_sum", 160, 0, true, time.Minute, ""},
+		{"vcenter", "vc", "average_avg", 160, 0, true, time.Minute, ""},
+	}
+	if len(aggregates) != len(tests) {
+		t.Fatalf("%d aggregates, want %d: %+v", len(aggregates), len(tests), aggregates)
+	}
+	for i, test := range tests {
+		point := aggregates[i]
+		name := test.objectType + "." + test.objectName + "." + test.rollup
+		if point.ObjectType != test.objectType || point.ObjectName != test.objectName || point.Rollup != test.rollup || point.Timestamp != test.timestamp {
+			t.Errorf("%s: unexpected aggregate %+v", name, point)
+			continue
+		}
+		if point.VCenter != "vc" || point.Group != "cpu" || point.Counter != "usagemhz" || point.Instance != "hostsystem" {
+			t.Errorf("%s: unexpected metric %+v", name, point)
+		}
+		if math.Abs(point.Value-test.value) > 1e-9 {
+			t.Errorf("%s: value %v, want %v", name, point.Value, test.value)
+		}
+		if point.Float != test.float {
+			t.Errorf("%s: float %v, want %v", name, point.Float, test.float)
+		}
+		if point.Span != test.span {
+			t.Errorf("%s: span %v, want %v", name, point.Span, test.span)
+		}
+		if point.Labels["datacenter"] != test.datacenter {
+			t.Errorf("%s: datacenter %q, want %q", name, point.Labels["datacenter"], test.datacenter)
+		}
+	}
+
+	if aggregates := aggregate(points, nil); len(aggregates) != 0 {
+		t.Errorf("aggregates without functions: %+v", aggregates)
+	}
+}
+
+func TestValidateAggregates(t *testing.T) {
+	tests := []struct {
+		metricdef MetricDef
+		valid     bool
+	}{
+		{MetricDef{Metric: "cpu.usage.average"}, true},
+		{MetricDef{Metric: "cpu.usage.average", Function: "P95", Aggregate: []string{"max", "count"}}, true},
+		{MetricDef{Metric: "cpu.usage.average", Function: "median"}, false},
+		{MetricDef{Metric: "cpu.usage.average", Aggregate: []string{"sum", "total"}}, false},
+	}
+	for _, test := range tests {
+		if err := validateAggregates(test.metricdef); (err == nil) != test.valid {
+			t.Errorf("%+v: error %v, want valid %v", test.metricdef, err, test.valid)
+		}
+	}
+}
+
+func TestSeriesFunction(t *testing.T) {
+	tests := []struct {
+		metricdef MetricDef
+		function  string
+	}{
+		{MetricDef{Metric: "cpu.usage.average"}, "avg"},
+		{MetricDef{Metric: "cpu.ready.summation"}, "sum"},
+		{MetricDef{Metric: "disk.maxTotalLatency.latest"}, "last"},
+		{MetricDef{Metric: "cpu.usage.maximum"}, "max"},
+		{MetricDef{Metric: "cpu.usage.average", Function: "P95"}, "p95"},
+	}
+	for _, test := range tests {
+		if function := seriesFunction(test.metricdef); function != test.function {
+			t.Errorf("%s: function %s, want %s", test.metricdef.Metric, function, test.function)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package vsphere
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// available counters of an entity are refreshed after this duration, plus a random spread of up to the same duration
+// so that the entities cached together are not all refreshed in the same query
+const availableCacheDuration = 30 * time.Minute
+
+// maxAvailableLookups bounds the entities whose available counters are retrieved in one query,
+// the others are queried without check until their turn comes
+const maxAvailableLookups = 100
+
+// availableEntry is the available counters of an entity and their expiration
+type availableEntry struct {
+	expires  time.Time
+	counters map[int32]bool
+}
+
+// availableCache keeps the counters available for entities between queries.
+// Querying them is one call per entity so only unknown and expired entities are queried.
+type availableCache struct {
+	sync.Mutex
+	morToEntry map[types.ManagedObjectReference]availableEntry
+}
+
+// checksAvailable tells if the available counters of an object type are checked before querying
+func (vcenter *VCenter) checksAvailable(objectType string) bool {
+	for _, checked := range vcenter.AvailableMetrics {
+		if strings.EqualFold(checked, objectType) {
+			return true
+		}
+	}
+	return false
+}
+
+// availableCounters gets the realtime counters available for the entities of the checked object types.
+// Entities whose counters could not be retrieved are not in the result.
+func (vcenter *VCenter) availableCounters(ctx context.Context, client *govmomi.Client, mors []types.ManagedObjectReference) map[types.ManagedObjectReference]map[int32]bool {
+	morToCounters := make(map[types.ManagedObjectReference]map[int32]bool)
+	if len(vcenter.AvailableMetrics) == 0 {
+		return morToCounters
+	}
+	cache := vcenter.availableCache
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+	lookups := 0
+	for _, mor := range mors {
+		if !vcenter.checksAvailable(mor.Type) {
+			continue
+		}
+		entry, ok := cache.morToEntry[mor]
+		if ok && now.Before(entry.expires) {
+			morToCounters[mor] = entry.counters
+			continue
+		}
+		if lookups >= maxAvailableLookups {
+			// expired counters are still used until they are refreshed
+			if ok {
+				morToCounters[mor] = entry.counters
+			}
+			continue
+		}
+		lookups++
+		req := types.QueryAvailablePerfMetric{This: *client.ServiceContent.PerfManager, Entity: mor, IntervalId: 20}
+		res, err := methods.QueryAvailablePerfMetric(ctx, client.RoundTripper, &req)
+		if err != nil {
+			errlog.Println("Could not get available metrics of " + mor.String() + " from vcenter " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			continue
+		}
+		counters := make(map[int32]bool)
+		for _, metricId := range res.Returnval {
+			counters[metricId.CounterId] = true
+		}
+		morToCounters[mor] = counters
+		if len(counters) == 0 {
+			// entities without counters, i.e.: a powered off virtual machine, are looked up again next time
+			delete(cache.morToEntry, mor)
+			continue
+		}
+		spread := time.Duration(rand.Int63n(int64(availableCacheDuration)))
+		cache.morToEntry[mor] = availableEntry{expires: now.Add(availableCacheDuration + spread), counters: counters}
+	}
+	if Debug && lookups >= maxAvailableLookups {
+		stdlog.Println("Available metrics lookups of vcenter " + vcenter.Hostname + " reached the limit of " + strconv.Itoa(maxAvailableLookups) + ", the others are done in the next queries")
+	}
+	return morToCounters
+}
@@ -0,0 +1,276 @@
+package vsphere
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Filter selects objects on their properties with regular expressions.
+// Empty fields match any object, all the others must match.
+type Filter struct {
+	Name         string
+	Folder       string
+	Cluster      string
+	Datacenter   string
+	ResourcePool string
+	Tag          string
+}
+
+// compiled filter
+type filter struct {
+	name         *regexp.Regexp
+	folder       *regexp.Regexp
+	cluster      *regexp.Regexp
+	datacenter   *regexp.Regexp
+	resourcePool *regexp.Regexp
+	tag          *regexp.Regexp
+}
+
+// selector decides which objects a metric definition is collected for
+type selector struct {
+	include []filter
+	exclude []filter
+}
+
+// objectInfo holds the properties objects are filtered on
+type objectInfo struct {
+	name         string
+	folder       string
+	cluster      string
+	datacenter   string
+	resourcePool string
+	vApp         string
+	tags         []string
+}
+
+// compileRegexp compiles an optional regular expression
+func compileRegexp(field string, expr string) (*regexp.Regexp, error) {
+	if len(expr) == 0 {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.New("Invalid " + field + " filter '" + expr + "': " + err.Error())
+	}
+	return re, nil
+}
+
+// compile the regular expressions of the filter
+func (f *Filter) compile() (filter, error) {
+	var compiled filter
+	var err error
+	if compiled.name, err = compileRegexp("Name", f.Name); err != nil {
+		return compiled, err
+	}
+	if compiled.folder, err = compileRegexp("Folder", f.Folder); err != nil {
+		return compiled, err
+	}
+	if compiled.cluster, err = compileRegexp("Cluster", f.Cluster); err != nil {
+		return compiled, err
+	}
+	if compiled.datacenter, err = compileRegexp("Datacenter", f.Datacenter); err != nil {
+		return compiled, err
+	}
+	if compiled.resourcePool, err = compileRegexp("ResourcePool", f.ResourcePool); err != nil {
+		return compiled, err
+	}
+	if compiled.tag, err = compileRegexp("Tag", f.Tag); err != nil {
+		return compiled, err
+	}
+	return compiled, nil
+}
+
+// matches checks that every expression of the filter matches the object
+func (f *filter) matches(info *objectInfo) bool {
+	if f.name != nil && !f.name.MatchString(info.name) {
+		return false
+	}
+	if f.folder != nil && !f.folder.MatchString(info.folder) {
+		return false
+	}
+	if f.cluster != nil && !f.cluster.MatchString(info.cluster) {
+		return false
+	}
+	if f.datacenter != nil && !f.datacenter.MatchString(info.datacenter) {
+		return false
+	}
+	if f.resourcePool != nil && !f.resourcePool.MatchString(info.resourcePool) {
+		return false
+	}
+	if f.tag != nil {
+		found := false
+		for _, tag := range info.tags {
+			if f.tag.MatchString(tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the selection, filters, instance filters, aggregations, transforms and derived metrics of the metric
+func (metric *Metric) Validate() error {
+	for _, metricdef := range metric.Definition {
+		if err := validateSelection(metricdef); err != nil {
+			return err
+		}
+		if err := validateAggregates(metricdef); err != nil {
+			return err
+		}
+		if err := validateTransforms(metricdef); err != nil {
+			return err
+		}
+		if _, err := metricdef.instanceFilter(); err != nil {
+			return err
+		}
+	}
+	for _, derived := range metric.Derived {
+		if err := validateDerived(derived); err != nil {
+			return err
+		}
+	}
+	_, err := metric.selector()
+	return err
+}
+
+// selector compiles the include and exclude filters of the metric
+func (metric *Metric) selector() (*selector, error) {
+	if len(metric.Include) == 0 && len(metric.Exclude) == 0 {
+		return nil, nil
+	}
+	sel := selector{}
+	for _, f := range metric.Include {
+		compiled, err := f.compile()
+		if err != nil {
+			return nil, err
+		}
+		sel.include = append(sel.include, compiled)
+	}
+	for _, f := range metric.Exclude {
+		compiled, err := f.compile()
+		if err != nil {
+			return nil, err
+		}
+		sel.exclude = append(sel.exclude, compiled)
+	}
+	return &sel, nil
+}
+
+// selects checks if the object is included and not excluded.
+// A nil selector selects every object.
+func (sel *selector) selects(info *objectInfo) bool {
+	if sel == nil {
+		return true
+	}
+	if len(sel.include) > 0 {
+		included := false
+		for i := range sel.include {
+			if sel.include[i].matches(info) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for i := range sel.exclude {
+		if sel.exclude[i].matches(info) {
+			return false
+		}
+	}
+	return true
+}
+
+// usesTags checks if a filter of the selector needs the vSphere tags
+func (sel *selector) usesTags() bool {
+	if sel == nil {
+		return false
+	}
+	for _, filters := range [][]filter{sel.include, sel.exclude} {
+		for _, f := range filters {
+			if f.tag != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// folderPath returns the path of the folders containing an object, below the datacenter root folders
+func folderPath(mor types.ManagedObjectReference, morToName map[types.ManagedObjectReference]string, morToParent map[types.ManagedObjectReference]types.ManagedObjectReference) string {
+	folders := []string{}
+	parent, ok := morToParent[mor]
+	for ok && parent.Type == "Folder" {
+		grandparent, found := morToParent[parent]
+		if found && grandparent.Type == "Datacenter" {
+			// root folder of the datacenter (vm, host, datastore or network)
+			break
+		}
+		folders = append([]string{morToName[parent]}, folders...)
+		parent, ok = grandparent, found
+	}
+	return "/" + strings.Join(folders, "/")
+}
+
+// instanceFilter selects the instances of a metric with regular expressions
+type instanceFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// instanceFilter compiles the instance include and exclude patterns of the metric definition
+func (metricdef *MetricDef) instanceFilter() (*instanceFilter, error) {
+	if len(metricdef.IncludeInstances) == 0 && len(metricdef.ExcludeInstances) == 0 {
+		return nil, nil
+	}
+	f := instanceFilter{}
+	for _, pattern := range metricdef.IncludeInstances {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.New("Invalid instance pattern " + pattern + " of metric " + metricdef.Metric + ": " + err.Error())
+		}
+		f.include = append(f.include, compiled)
+	}
+	for _, pattern := range metricdef.ExcludeInstances {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.New("Invalid instance pattern " + pattern + " of metric " + metricdef.Metric + ": " + err.Error())
+		}
+		f.exclude = append(f.exclude, compiled)
+	}
+	return &f, nil
+}
+
+// selects checks if the instance is included and not excluded.
+// A nil filter and the total (empty instance) select every instance.
+func (f *instanceFilter) selects(instance string) bool {
+	if f == nil || len(instance) == 0 {
+		return true
+	}
+	if len(f.include) > 0 {
+		included := false
+		for _, include := range f.include {
+			if include.MatchString(instance) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, exclude := range f.exclude {
+		if exclude.MatchString(instance) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package vsphere
+
+import (
+	"strings"
+
+	"github.com/whpv/vsphere-graphite/backend"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// properties of virtual machines retrieved when guest info is collected
+var guestProperties = []string{"guest.disk", "guest.toolsRunningStatus", "guest.guestState", "guest.net", "summary.quickStats"}
+
+// guestInfo is the guest operating system view of a virtual machine, as reported by the vmware tools
+type guestInfo struct {
+	disks       []types.GuestDiskInfo
+	toolsStatus string
+	state       string
+	ipAddresses []string
+	quickStats  *types.VirtualMachineQuickStats
+}
+
+// set records a guest property, it returns false if the property value is not of the expected type
+func (info *guestInfo) set(property types.DynamicProperty) bool {
+	switch property.Name {
+	case "guest.disk":
+		disks, ok := property.Val.(types.ArrayOfGuestDiskInfo)
+		if !ok {
+			return false
+		}
+		info.disks = disks.GuestDiskInfo
+	case "guest.toolsRunningStatus":
+		status, ok := property.Val.(string)
+		if !ok {
+			return false
+		}
+		info.toolsStatus = status
+	case "guest.guestState":
+		state, ok := property.Val.(string)
+		if !ok {
+			return false
+		}
+		info.state = state
+	case "guest.net":
+		nics, ok := property.Val.(types.ArrayOfGuestNicInfo)
+		if !ok {
+			return false
+		}
+		for _, nic := range nics.GuestNicInfo {
+			info.ipAddresses = append(info.ipAddresses, nic.IpAddress...)
+		}
+	case "summary.quickStats":
+		quickStats, ok := property.Val.(types.VirtualMachineQuickStats)
+		if !ok {
+			return false
+		}
+		info.quickStats = &quickStats
+	}
+	return true
+}
+
+// points converts the guest info of a virtual machine to points of the guest group.
+// The disk points have the guest mount point as instance, the ip addresses are added to the labels.
+func (info *guestInfo) points(template backend.Point) []backend.Point {
+	labels := map[string]string{}
+	for label, value := range template.Labels {
+		labels[label] = value
+	}
+	if len(info.ipAddresses) > 0 {
+		labels["ipaddress"] = strings.Join(info.ipAddresses, ",")
+	}
+	template.Labels = labels
+	template.Group = "guest"
+	template.Rollup = "latest"
+
+	points := []backend.Point{}
+	add := func(counter, instance string, value float64) {
+		point := template
+		point.Counter = counter
+		point.Instance = instance
+		point.Value = value
+		points = append(points, point)
+	}
+	for _, disk := range info.disks {
+		add("diskcapacity", disk.DiskPath, float64(disk.Capacity))
+		add("diskfree", disk.DiskPath, float64(disk.FreeSpace))
+	}
+	if len(info.toolsStatus) > 0 {
+		var running float64
+		if info.toolsStatus == "guestToolsRunning" {
+			running = 1
+		}
+		add("toolsrunning", "", running)
+	}
+	if len(info.state) > 0 {
+		var running float64
+		if info.state == "running" {
+			running = 1
+		}
+		add("running", "", running)
+	}
+	if info.quickStats != nil {
+		add("memoryusage", "", float64(info.quickStats.GuestMemoryUsage))
+		add("hostmemoryusage", "", float64(info.quickStats.HostMemoryUsage))
+		add("uptime", "", float64(info.quickStats.UptimeSeconds))
+	}
+	return points
+}
@@ -0,0 +1,81 @@
+package vsphere
+
+import (
+	"github.com/whpv/vsphere-graphite/backend"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// runtimeState is the power state of a virtual machine or the connection state of a host
+type runtimeState struct {
+	powerState      types.VirtualMachinePowerState
+	connectionState types.HostSystemConnectionState
+	maintenance     bool
+}
+
+// set records a runtime property, it returns false if the property value is not of the expected type
+func (state *runtimeState) set(property types.DynamicProperty) bool {
+	switch property.Name {
+	case "runtime.powerState":
+		powerState, ok := property.Val.(types.VirtualMachinePowerState)
+		if !ok {
+			return false
+		}
+		state.powerState = powerState
+	case "runtime.connectionState":
+		connectionState, ok := property.Val.(types.HostSystemConnectionState)
+		if !ok {
+			return false
+		}
+		state.connectionState = connectionState
+	case "runtime.inMaintenanceMode":
+		maintenance, ok := property.Val.(bool)
+		if !ok {
+			return false
+		}
+		state.maintenance = maintenance
+	}
+	return true
+}
+
+// active tells if the object has performance counters: powered on virtual machines
+// and connected hosts not in maintenance
+func (state *runtimeState) active() bool {
+	if len(state.powerState) > 0 && state.powerState != types.VirtualMachinePowerStatePoweredOn {
+		return false
+	}
+	if len(state.connectionState) > 0 && state.connectionState != types.HostSystemConnectionStateConnected {
+		return false
+	}
+	return !state.maintenance
+}
+
+// points converts the runtime state to points of the runtime group, the raw state is added to the labels
+func (state *runtimeState) points(template backend.Point) []backend.Point {
+	template.Group = "runtime"
+	template.Rollup = "latest"
+	points := []backend.Point{}
+	add := func(counter, raw string, value bool) {
+		point := template
+		point.Counter = counter
+		if len(raw) > 0 {
+			point.Labels = map[string]string{}
+			for label, value := range template.Labels {
+				point.Labels[label] = value
+			}
+			point.Labels["state"] = raw
+		}
+		if value {
+			point.Value = 1
+		}
+		points = append(points, point)
+	}
+	if len(state.powerState) > 0 {
+		add("poweredon", string(state.powerState), state.powerState == types.VirtualMachinePowerStatePoweredOn)
+	}
+	if len(state.connectionState) > 0 {
+		add("connected", string(state.connectionState), state.connectionState == types.HostSystemConnectionStateConnected)
+		add("maintenance", "", state.maintenance)
+	}
+	return points
+}
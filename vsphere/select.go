@@ -0,0 +1,144 @@
+package vsphere
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// presets are named sets of metric definitions
+var presets = map[string][]MetricDef{
+	"vm-basic": {
+		{Metric: "cpu.usage.average"},
+		{Metric: "cpu.usagemhz.average"},
+		{Metric: "cpu.ready.summation"},
+		{Metric: "mem.usage.average"},
+		{Metric: "mem.consumed.average"},
+		{Metric: "mem.active.average"},
+		{Metric: "disk.usage.average"},
+		{Metric: "disk.maxTotalLatency.latest"},
+		{Metric: "net.usage.average"},
+	},
+	"vm-disk": {
+		{Metric: "virtualDisk.read.average", Instances: "*"},
+		{Metric: "virtualDisk.write.average", Instances: "*"},
+		{Metric: "virtualDisk.totalReadLatency.average", Instances: "*"},
+		{Metric: "virtualDisk.totalWriteLatency.average", Instances: "*"},
+	},
+	"host-basic": {
+		{Metric: "cpu.usage.average"},
+		{Metric: "cpu.usagemhz.average"},
+		{Metric: "mem.usage.average"},
+		{Metric: "mem.consumed.average"},
+		{Metric: "mem.totalCapacity.average"},
+		{Metric: "disk.usage.average"},
+		{Metric: "disk.maxTotalLatency.latest"},
+		{Metric: "net.usage.average"},
+	},
+	"host-network": {
+		{Metric: "net.received.average", Instances: "*"},
+		{Metric: "net.transmitted.average", Instances: "*"},
+		{Metric: "net.droppedRx.summation", Instances: "*"},
+		{Metric: "net.droppedTx.summation", Instances: "*"},
+	},
+}
+
+// presetNames lists the known presets
+func presetNames() []string {
+	names := []string{}
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateSelection checks the preset and the metric pattern of a metric definition
+func validateSelection(metricdef MetricDef) error {
+	if len(metricdef.Preset) > 0 {
+		if _, ok := presets[strings.ToLower(metricdef.Preset)]; !ok {
+			return errors.New("Unknown preset " + metricdef.Preset + ", use " + strings.Join(presetNames(), ", "))
+		}
+		return nil
+	}
+	if len(metricdef.Metric) == 0 && metricdef.Level <= 0 {
+		return errors.New("Metric definitions need a Metric, a Level or a Preset")
+	}
+	if _, err := path.Match(metricdef.Metric, ""); err != nil {
+		return errors.New("Invalid metric pattern " + metricdef.Metric)
+	}
+	return nil
+}
+
+// expandPresets replaces the presets by their metric definitions, which keep the other settings of the preset definition
+func expandPresets(metricdefs []MetricDef) []MetricDef {
+	expanded := []MetricDef{}
+	for _, metricdef := range metricdefs {
+		if len(metricdef.Preset) == 0 {
+			expanded = append(expanded, metricdef)
+			continue
+		}
+		for _, preset := range presets[strings.ToLower(metricdef.Preset)] {
+			presetdef := metricdef
+			presetdef.Preset = ""
+			presetdef.Metric = preset.Metric
+			presetdef.Instances = preset.Instances
+			expanded = append(expanded, presetdef)
+		}
+	}
+	return expanded
+}
+
+// matches tells if a metric definition selects a performance counter: by name or wildcard pattern
+// (i.e.: cpu.*.average) and up to a statistics level
+func (metricdef *MetricDef) matches(perf types.PerfCounterInfo) bool {
+	if len(metricdef.Metric) > 0 {
+		matched, err := path.Match(strings.ToLower(metricdef.Metric), strings.ToLower(counterName(perf)))
+		if err != nil || !matched {
+			return false
+		}
+	}
+	if metricdef.Level > 0 && perf.Level > metricdef.Level {
+		return false
+	}
+	return len(metricdef.Metric) > 0 || metricdef.Level > 0
+}
+
+// definitionFor returns the definition selecting a performance counter, or nil if none does.
+// A definition naming the counter beats patterns and levels, otherwise the first matching definition wins.
+func definitionFor(metricdefs []MetricDef, perf types.PerfCounterInfo) *MetricDef {
+	var found *MetricDef
+	for i := range metricdefs {
+		metricdef := &metricdefs[i]
+		if !metricdef.matches(perf) {
+			continue
+		}
+		if !metricdef.expanded() {
+			return metricdef
+		}
+		if found == nil {
+			found = metricdef
+		}
+	}
+	return found
+}
+
+// selection describes the counters a metric definition selects
+func (metricdef *MetricDef) selection() string {
+	if metricdef.Level <= 0 {
+		return metricdef.Metric
+	}
+	if len(metricdef.Metric) == 0 {
+		return "level " + strconv.Itoa(int(metricdef.Level)) + " counters"
+	}
+	return metricdef.Metric + " up to level " + strconv.Itoa(int(metricdef.Level))
+}
+
+// expanded tells if a metric definition is not a single counter
+func (metricdef *MetricDef) expanded() bool {
+	return metricdef.Level > 0 || strings.ContainsAny(metricdef.Metric, "*?[")
+}
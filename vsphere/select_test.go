@@ -0,0 +1,41 @@
+package vsphere
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestDefinitionFor(t *testing.T) {
+	perf := types.PerfCounterInfo{
+		Key:        2,
+		GroupInfo:  &types.ElementDescription{Key: "cpu"},
+		NameInfo:   &types.ElementDescription{Key: "usage"},
+		RollupType: "average",
+		Level:      1,
+	}
+	tests := []struct {
+		name     string
+		defs     []MetricDef
+		selected int
+	}{
+		{"none", []MetricDef{{Metric: "mem.usage.average"}}, -1},
+		{"exact", []MetricDef{{Metric: "cpu.usage.average"}}, 0},
+		{"first pattern", []MetricDef{{Metric: "mem.*"}, {Metric: "cpu.*.average"}, {Metric: "cpu.usage.*"}}, 1},
+		{"exact after pattern", []MetricDef{{Metric: "cpu.*.average"}, {Metric: "cpu.usage.average", Unit: "ratio"}}, 1},
+		{"exact after level", []MetricDef{{Level: 1}, {Metric: "CPU.Usage.Average"}}, 1},
+		{"first exact", []MetricDef{{Metric: "cpu.usage.average"}, {Metric: "cpu.usage.average", Rate: true}}, 0},
+	}
+	for _, test := range tests {
+		metricdef := definitionFor(test.defs, perf)
+		selected := -1
+		for i := range test.defs {
+			if metricdef == &test.defs[i] {
+				selected = i
+			}
+		}
+		if selected != test.selected {
+			t.Errorf("%s: definition %d selected, want %d", test.name, selected, test.selected)
+		}
+	}
+}
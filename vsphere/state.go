@@ -0,0 +1,248 @@
+package vsphere
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/whpv/vsphere-graphite/backend"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vcenter keeps about an hour of realtime samples
+const realtimeRetention = time.Hour
+
+// missed windows are queried by chunks of this duration
+const backfillChunk = 15 * time.Minute
+
+// state keeps the timestamp of the last sample sent to the backend per vcenter name, and per entity (moref)
+// of each vcenter as entities can be a few samples behind each other.
+// It is persisted to disk so that samples missed during outages can be backfilled.
+var state = struct {
+	sync.Mutex
+	file     string
+	last     map[string]int64
+	entities map[string]map[string]int64
+}{last: map[string]int64{}, entities: map[string]map[string]int64{}}
+
+// stateFile is the content of the state file
+type stateFile struct {
+	VCenters map[string]int64
+	Entities map[string]map[string]int64
+}
+
+// LoadState reads the last sent samples from a file, the file is then used to save them.
+// Files of previous versions only have the vcenters.
+func LoadState(file string) error {
+	state.Lock()
+	defer state.Unlock()
+	state.file = file
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	last := map[string]int64{}
+	if json.Unmarshal(content, &last) == nil {
+		state.last = last
+		return nil
+	}
+	saved := stateFile{}
+	err = json.Unmarshal(content, &saved)
+	if err != nil {
+		return err
+	}
+	if saved.VCenters != nil {
+		state.last = saved.VCenters
+	}
+	if saved.Entities != nil {
+		state.entities = saved.Entities
+	}
+	return nil
+}
+
+// snapshotGroups are the groups of the points read from the inventory instead of the performance samples.
+// They are stamped with the end of the query when there is no sample and must not move the state.
+var snapshotGroups = map[string]bool{
+	"runtime": true,
+	"guest":   true,
+}
+
+// Commit records the points accepted by the backend and saves the state.
+// Only the performance samples are recorded, entities without sample for longer than vcenter keeps them are forgotten.
+func Commit(points []backend.Point) error {
+	state.Lock()
+	defer state.Unlock()
+	changed := false
+	for _, point := range points {
+		if point.ObjectType == "collector" || snapshotGroups[point.Group] {
+			continue
+		}
+		if point.Timestamp > state.last[point.VCenter] {
+			state.last[point.VCenter] = point.Timestamp
+			changed = true
+		}
+		if len(point.MoRef) == 0 {
+			// aggregates
+			continue
+		}
+		entities, ok := state.entities[point.VCenter]
+		if !ok {
+			entities = map[string]int64{}
+			state.entities[point.VCenter] = entities
+		}
+		if point.Timestamp > entities[point.MoRef] {
+			entities[point.MoRef] = point.Timestamp
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	for vcName, entities := range state.entities {
+		for moref, last := range entities {
+			if state.last[vcName]-last > int64(realtimeRetention/time.Second) {
+				delete(entities, moref)
+			}
+		}
+	}
+	if len(state.file) == 0 {
+		return nil
+	}
+	content, err := json.Marshal(stateFile{VCenters: state.last, Entities: state.entities})
+	if err != nil {
+		return err
+	}
+	tmp := state.file + ".tmp"
+	err = ioutil.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, state.file)
+}
+
+// queryStart returns the start of the query window for a vcenter: the last sample sent, less an interval
+// for the entities behind the others, so that no sample is missed. Without state the window is the interval
+// and it never goes further back than what vcenter keeps.
+func queryStart(vcName string, interval int, endTime time.Time) time.Time {
+	state.Lock()
+	last, ok := state.last[vcName]
+	state.Unlock()
+	if !ok {
+		return endTime.Add(-time.Duration(interval) * time.Second)
+	}
+	start := time.Unix(last, 0).Add(-time.Duration(interval) * time.Second)
+	if endTime.Sub(start) > realtimeRetention {
+		errlog.Println("Samples of vcenter " + vcName + " since " + start.String() + " are no longer available, backfilling the last hour")
+		return endTime.Add(-realtimeRetention)
+	}
+	return start
+}
+
+// sentSamples returns the timestamp of the last sample sent per entity (moref) of a vcenter
+func sentSamples(vcName string) map[string]int64 {
+	state.Lock()
+	defer state.Unlock()
+	sent := make(map[string]int64, len(state.entities[vcName]))
+	for moref, last := range state.entities[vcName] {
+		sent[moref] = last
+	}
+	return sent
+}
+
+// firstUnsent returns the index of the first sample after the last one sent, samples are in time order
+func firstUnsent(infos []types.PerfSampleInfo, last int64) int {
+	for i, info := range infos {
+		if info.Timestamp.Unix() > last {
+			return i
+		}
+	}
+	return len(infos)
+}
+
+// completeUntil returns the time up to which the samples of all the entities are available: the newest sample
+// of the entity the most behind. Entities more than lateness behind the end of the query are not waited for.
+func completeUntil(newest map[types.ManagedObjectReference]time.Time, endTime time.Time, lateness time.Duration) time.Time {
+	complete := endTime
+	for _, timestamp := range newest {
+		if timestamp.Before(complete) {
+			complete = timestamp
+		}
+	}
+	if floor := endTime.Add(-lateness); complete.Before(floor) {
+		return floor
+	}
+	return complete
+}
+
+// realtime samples are 20 seconds apart
+const realtimeInterval = 20 * time.Second
+
+// sampleBucket is a group of samples aggregated in one point
+type sampleBucket struct {
+	timestamp time.Time
+	interval  time.Duration
+	values    []int64
+}
+
+// span returns the duration covered by the value of the bucket collapsed with a function:
+// every valid sample for a sum, one sample for the other functions
+func (bucket *sampleBucket) span(function string) time.Duration {
+	if function != "sum" {
+		return bucket.interval
+	}
+	valid := 0
+	for _, value := range bucket.values {
+		if value >= 0 {
+			valid++
+		}
+	}
+	return time.Duration(valid) * bucket.interval
+}
+
+// sampleInterval returns the interval of a sample
+func sampleInterval(info types.PerfSampleInfo) time.Duration {
+	if info.Interval > 0 {
+		return time.Duration(info.Interval) * time.Second
+	}
+	return realtimeInterval
+}
+
+// bucketSamples groups the samples by period, timestamped with the end of their period
+// so that the buckets of all entities line up. With no period all the samples are in one group.
+func bucketSamples(infos []types.PerfSampleInfo, values []int64, period time.Duration) []sampleBucket {
+	count := len(infos)
+	if len(values) < count {
+		count = len(values)
+	}
+	buckets := []sampleBucket{}
+	if count == 0 {
+		return buckets
+	}
+	if period <= 0 {
+		return append(buckets, sampleBucket{timestamp: infos[count-1].Timestamp, interval: sampleInterval(infos[count-1]), values: values[:count]})
+	}
+	var current *sampleBucket
+	var end time.Time
+	for i := 0; i < count; i++ {
+		timestamp := infos[i].Timestamp
+		if current == nil || timestamp.After(end) {
+			if current != nil {
+				buckets = append(buckets, *current)
+			}
+			// buckets end on period boundaries
+			end = timestamp.Truncate(period)
+			if end.Before(timestamp) {
+				end = end.Add(period)
+			}
+			current = &sampleBucket{timestamp: end, interval: sampleInterval(infos[i])}
+		}
+		current.values = append(current.values, values[i])
+	}
+	return append(buckets, *current)
+}
@@ -0,0 +1,260 @@
+package vsphere
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/whpv/vsphere-graphite/backend"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func init() {
+	stdlog = log.New(ioutil.Discard, "", 0)
+	errlog = log.New(ioutil.Discard, "", 0)
+}
+
+// resetState clears the global state and sets its file
+func resetState(file string) {
+	state.Lock()
+	defer state.Unlock()
+	state.file = file
+	state.last = map[string]int64{}
+	state.entities = map[string]map[string]int64{}
+}
+
+// sampleInfos returns samples every 20 seconds from start
+func sampleInfos(start time.Time, count int) []types.PerfSampleInfo {
+	infos := make([]types.PerfSampleInfo, count)
+	for i := range infos {
+		infos[i] = types.PerfSampleInfo{Timestamp: start.Add(time.Duration(i*20) * time.Second), Interval: 20}
+	}
+	return infos
+}
+
+func TestBucketSamples(t *testing.T) {
+	start := time.Unix(1500000000, 0) // on a minute boundary
+	tests := []struct {
+		name       string
+		infos      []types.PerfSampleInfo
+		values     []int64
+		period     time.Duration
+		timestamps []int64
+		buckets    [][]int64
+	}{
+		{"empty", nil, nil, 0, []int64{}, [][]int64{}},
+		{"no period", sampleInfos(start, 3), []int64{1, 2, 3}, 0, []int64{1500000040}, [][]int64{{1, 2, 3}}},
+		{"more values than infos", sampleInfos(start, 2), []int64{1, 2, 3}, 0, []int64{1500000020}, [][]int64{{1, 2}}},
+		{"more infos than values", sampleInfos(start, 3), []int64{1, 2}, 0, []int64{1500000020}, [][]int64{{1, 2}}},
+		{"minute periods", sampleInfos(start.Add(20*time.Second), 6), []int64{1, 2, 3, 4, 5, 6}, time.Minute,
+			[]int64{1500000060, 1500000120}, [][]int64{{1, 2, 3}, {4, 5, 6}}},
+		{"partial last period", sampleInfos(start.Add(20*time.Second), 4), []int64{1, 2, 3, 4}, time.Minute,
+			[]int64{1500000060, 1500000120}, [][]int64{{1, 2, 3}, {4}}},
+		{"missing samples", sampleInfos(start.Add(20*time.Second), 3), []int64{-1, 2, -1}, time.Minute,
+			[]int64{1500000060}, [][]int64{{-1, 2, -1}}},
+	}
+	for _, test := range tests {
+		buckets := bucketSamples(test.infos, test.values, test.period)
+		timestamps := []int64{}
+		values := [][]int64{}
+		for _, bucket := range buckets {
+			timestamps = append(timestamps, bucket.timestamp.Unix())
+			values = append(values, bucket.values)
+		}
+		if !reflect.DeepEqual(timestamps, test.timestamps) {
+			t.Errorf("%s: timestamps %v, want %v", test.name, timestamps, test.timestamps)
+		}
+		if !reflect.DeepEqual(values, test.buckets) {
+			t.Errorf("%s: buckets %v, want %v", test.name, values, test.buckets)
+		}
+	}
+}
+
+func TestQueryStart(t *testing.T) {
+	end := time.Unix(1500000000, 0)
+	tests := []struct {
+		name  string
+		last  map[string]int64
+		start int64
+	}{
+		{"no state", map[string]int64{}, 1500000000 - 60},
+		{"other vcenter", map[string]int64{"other": 1500000000 - 600}, 1500000000 - 60},
+		{"last sample", map[string]int64{"vc": 1500000000 - 600}, 1500000000 - 660},
+		{"beyond retention", map[string]int64{"vc": 1500000000 - 7200}, 1500000000 - 3600},
+	}
+	for _, test := range tests {
+		resetState("")
+		state.last = test.last
+		start := queryStart("vc", 60, end)
+		if start.Unix() != test.start {
+			t.Errorf("%s: start %d, want %d", test.name, start.Unix(), test.start)
+		}
+	}
+}
+
+func TestCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	resetState(file)
+	err = Commit([]backend.Point{
+		{VCenter: "vc1", ObjectType: "hostsystem", MoRef: "host-1", Timestamp: 100},
+		{VCenter: "vc1", ObjectType: "hostsystem", MoRef: "host-1", Timestamp: 300},
+		{VCenter: "vc1", ObjectType: "hostsystem", MoRef: "host-2", Timestamp: 200},
+		{VCenter: "vc1", ObjectType: "cluster", Timestamp: 300},
+		{VCenter: "vc2", ObjectType: "virtualmachine", MoRef: "vm-1", Timestamp: 150},
+		{VCenter: "vc1", ObjectType: "collector", Timestamp: 900},
+		{VCenter: "vc1", ObjectType: "virtualmachine", Group: "runtime", Timestamp: 900},
+		{VCenter: "vc2", ObjectType: "virtualmachine", Group: "guest", Timestamp: 900},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"vc1": 300, "vc2": 150}
+	wantEntities := map[string]map[string]int64{"vc1": {"host-1": 300, "host-2": 200}, "vc2": {"vm-1": 150}}
+	if !reflect.DeepEqual(state.last, want) {
+		t.Errorf("state %v, want %v", state.last, want)
+	}
+	if !reflect.DeepEqual(state.entities, wantEntities) {
+		t.Errorf("entities %v, want %v", state.entities, wantEntities)
+	}
+	if sent := sentSamples("vc1"); !reflect.DeepEqual(sent, wantEntities["vc1"]) {
+		t.Errorf("sent samples %v, want %v", sent, wantEntities["vc1"])
+	}
+
+	// older points don't move the state back
+	err = Commit([]backend.Point{{VCenter: "vc1", ObjectType: "hostsystem", MoRef: "host-1", Timestamp: 250}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := stateFile{}
+	if err := json.Unmarshal(content, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, stateFile{VCenters: want, Entities: wantEntities}) {
+		t.Errorf("saved state %v, want %v and %v", saved, want, wantEntities)
+	}
+
+	// the saved state is loaded back
+	resetState("")
+	if err := LoadState(file); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state.last, want) || !reflect.DeepEqual(state.entities, wantEntities) {
+		t.Errorf("loaded state %v and %v, want %v and %v", state.last, state.entities, want, wantEntities)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary state file left behind")
+	}
+}
+
+func TestSampleBucketSpan(t *testing.T) {
+	bucket := sampleBucket{interval: 20 * time.Second, values: []int64{5, -1, 7, 9}}
+	tests := []struct {
+		function string
+		span     time.Duration
+	}{
+		{"sum", 60 * time.Second},
+		{"avg", 20 * time.Second},
+		{"max", 20 * time.Second},
+		{"last", 20 * time.Second},
+	}
+	for _, test := range tests {
+		if span := bucket.span(test.function); span != test.span {
+			t.Errorf("%s: span %v, want %v", test.function, span, test.span)
+		}
+	}
+	buckets := bucketSamples(sampleInfos(time.Unix(1500000000, 0), 3), []int64{1, 2, 3}, 0)
+	if len(buckets) != 1 || buckets[0].interval != 20*time.Second {
+		t.Errorf("buckets %+v, want one bucket of 20s samples", buckets)
+	}
+}
+
+func TestLoadPreviousState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(file, []byte(`{"vc1":300}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resetState("")
+	if err := LoadState(file); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state.last, map[string]int64{"vc1": 300}) || len(state.entities) != 0 {
+		t.Errorf("loaded state %v and %v, want the vcenters only", state.last, state.entities)
+	}
+}
+
+func TestCommitForgetsEntities(t *testing.T) {
+	resetState("")
+	err := Commit([]backend.Point{
+		{VCenter: "vc", ObjectType: "virtualmachine", MoRef: "vm-1", Timestamp: 1000},
+		{VCenter: "vc", ObjectType: "virtualmachine", MoRef: "vm-2", Timestamp: 1000 + 3600},
+		{VCenter: "vc", ObjectType: "virtualmachine", MoRef: "vm-3", Timestamp: 1000 + 3601},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"vm-2": 1000 + 3600, "vm-3": 1000 + 3601}
+	if !reflect.DeepEqual(state.entities["vc"], want) {
+		t.Errorf("entities %v, want %v", state.entities["vc"], want)
+	}
+}
+
+func TestFirstUnsent(t *testing.T) {
+	infos := sampleInfos(time.Unix(1500000000, 0), 3)
+	tests := []struct {
+		last  int64
+		first int
+	}{
+		{0, 0},
+		{1499999990, 0},
+		{1500000000, 1},
+		{1500000030, 2},
+		{1500000040, 3},
+	}
+	for _, test := range tests {
+		if first := firstUnsent(infos, test.last); first != test.first {
+			t.Errorf("last %d: first %d, want %d", test.last, first, test.first)
+		}
+	}
+}
+
+func TestCompleteUntil(t *testing.T) {
+	end := time.Unix(1500000000, 0)
+	vm := func(id string) types.ManagedObjectReference {
+		return types.ManagedObjectReference{Type: "VirtualMachine", Value: id}
+	}
+	tests := []struct {
+		name     string
+		newest   map[types.ManagedObjectReference]time.Time
+		complete int64
+	}{
+		{"no entity", map[types.ManagedObjectReference]time.Time{}, 1500000000},
+		{"entity behind", map[types.ManagedObjectReference]time.Time{vm("vm-1"): end.Add(-20 * time.Second), vm("vm-2"): end.Add(-40 * time.Second)}, 1500000000 - 40},
+		{"entity too late", map[types.ManagedObjectReference]time.Time{vm("vm-1"): end.Add(-20 * time.Second), vm("vm-2"): end.Add(-300 * time.Second)}, 1500000000 - 60},
+	}
+	for _, test := range tests {
+		if complete := completeUntil(test.newest, end, time.Minute); complete.Unix() != test.complete {
+			t.Errorf("%s: complete until %d, want %d", test.name, complete.Unix(), test.complete)
+		}
+	}
+}
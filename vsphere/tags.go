@@ -0,0 +1,129 @@
+package vsphere
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// attached tags are refreshed after this duration
+const tagCacheDuration = 10 * time.Minute
+
+// objectTag is a vSphere tag attached to an object
+type objectTag struct {
+	category string
+	name     string
+}
+
+// tagCache keeps the tags attached to objects between queries.
+// The vAPI tagging service is slow so only unknown objects are queried until the cache expires.
+type tagCache struct {
+	sync.Mutex
+	expires    time.Time
+	categories map[string]string
+	morToTags  map[types.ManagedObjectReference][]objectTag
+}
+
+// retrieveTags gets the vSphere tags attached to the objects through the vAPI tagging service
+func (vcenter *VCenter) retrieveTags(ctx context.Context, client *govmomi.Client, mors []types.ManagedObjectReference) (map[types.ManagedObjectReference][]objectTag, error) {
+	cache := vcenter.tagCache
+	cache.Lock()
+	defer cache.Unlock()
+	if time.Now().After(cache.expires) {
+		cache.expires = time.Now().Add(tagCacheDuration)
+		cache.categories = map[string]string{}
+		cache.morToTags = make(map[types.ManagedObjectReference][]objectTag)
+	}
+
+	incomplete := make(map[types.ManagedObjectReference]bool)
+	refs := []mo.Reference{}
+	for _, mor := range mors {
+		if _, ok := cache.morToTags[mor]; !ok {
+			refs = append(refs, mor)
+		}
+	}
+	if len(refs) > 0 {
+		restclient := rest.NewClient(client.Client)
+		err := restclient.Login(ctx, url.UserPassword(vcenter.Username, vcenter.Password))
+		if err != nil {
+			return cache.morToTags, err
+		}
+		defer restclient.Logout(ctx)
+
+		manager := tags.NewManager(restclient)
+		attached, err := manager.GetAttachedTagsOnObjects(ctx, refs)
+		if err != nil {
+			return cache.morToTags, err
+		}
+		// objects without tags are cached too
+		for _, ref := range refs {
+			cache.morToTags[ref.Reference()] = []objectTag{}
+		}
+		for _, objectTags := range attached {
+			mor := objectTags.ObjectID.Reference()
+			for _, tag := range objectTags.Tags {
+				category, ok := cache.categories[tag.CategoryID]
+				if !ok {
+					cat, err := manager.GetCategory(ctx, tag.CategoryID)
+					if err == nil && len(cat.Name) == 0 {
+						err = errors.New("category has no name")
+					}
+					if err != nil {
+						// the tag is skipped and the object queried again next time
+						errlog.Println("Could not get tag category " + tag.CategoryID + " from vcenter " + vcenter.Hostname)
+						errlog.Println("Error: ", err)
+						incomplete[mor] = true
+						continue
+					}
+					category = cat.Name
+					cache.categories[tag.CategoryID] = category
+				}
+				cache.morToTags[mor] = append(cache.morToTags[mor], objectTag{category: category, name: tag.Name})
+			}
+		}
+	}
+
+	morToTags := make(map[types.ManagedObjectReference][]objectTag, len(mors))
+	for _, mor := range mors {
+		morToTags[mor] = cache.morToTags[mor]
+	}
+	for mor := range incomplete {
+		delete(cache.morToTags, mor)
+	}
+	return morToTags, nil
+}
+
+// tagStrings returns the tags as category:tag
+func tagStrings(objectTags []objectTag) []string {
+	strs := make([]string, len(objectTags))
+	for i, tag := range objectTags {
+		strs[i] = tag.category + ":" + tag.name
+	}
+	return strs
+}
+
+// retrieveCustomFields gets the names of the custom attributes by key
+func retrieveCustomFields(ctx context.Context, client *govmomi.Client) (map[int32]string, error) {
+	fields := make(map[int32]string)
+	if client.ServiceContent.CustomFieldsManager == nil {
+		return fields, nil
+	}
+	var manager mo.CustomFieldsManager
+	err := client.RetrieveOne(ctx, *client.ServiceContent.CustomFieldsManager, []string{"field"}, &manager)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range manager.Field {
+		fields[field.Key] = field.Name
+	}
+	return fields, nil
+}
@@ -0,0 +1,162 @@
+package vsphere
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/whpv/vsphere-graphite/backend"
+)
+
+// unitConversions are the factors converting the unit of a performance counter to another unit
+var unitConversions = map[string]map[string]float64{
+	"kiloBytes":          {"bytes": 1024, "kilobytes": 1, "megabytes": 1.0 / 1024, "gigabytes": 1.0 / 1024 / 1024},
+	"megaBytes":          {"bytes": 1024 * 1024, "kilobytes": 1024, "megabytes": 1, "gigabytes": 1.0 / 1024},
+	"kiloBytesPerSecond": {"bytespersecond": 1024, "bitspersecond": 8 * 1024, "megabitspersecond": 8.0 / 1024},
+	"megaHertz":          {"hertz": 1000 * 1000, "megahertz": 1, "gigahertz": 1.0 / 1000},
+	"millisecond":        {"microseconds": 1000, "milliseconds": 1, "seconds": 1.0 / 1000},
+	"microsecond":        {"microseconds": 1, "milliseconds": 1.0 / 1000, "seconds": 1.0 / 1000 / 1000},
+	"percent":            {"percent": 1.0 / 100, "ratio": 1.0 / 100 / 100},
+}
+
+// Derived metric computed from two metrics of the same object
+type Derived struct {
+	Metric   string
+	Left     string
+	Operator string
+	Right    string
+	Scale    float64
+}
+
+// validateTransforms checks the unit conversion of a metric definition
+func validateTransforms(metricdef MetricDef) error {
+	if len(metricdef.Unit) == 0 {
+		return nil
+	}
+	for _, conversions := range unitConversions {
+		if _, ok := conversions[strings.ToLower(metricdef.Unit)]; ok {
+			return nil
+		}
+	}
+	return errors.New("Unknown unit " + metricdef.Unit + " of metric " + metricdef.Metric)
+}
+
+// validateDerived checks a derived metric definition
+func validateDerived(derived Derived) error {
+	if len(strings.Split(derived.Metric, ".")) != 3 {
+		return errors.New("Derived metric " + derived.Metric + " should be named group.counter.rollup")
+	}
+	if len(derived.Left) == 0 || len(derived.Right) == 0 {
+		return errors.New("Derived metric " + derived.Metric + " needs a Left and a Right metric")
+	}
+	switch derived.Operator {
+	case "+", "-", "*", "/":
+	default:
+		return errors.New("Unknown operator " + derived.Operator + " of derived metric " + derived.Metric + ", use +, -, * or /")
+	}
+	return nil
+}
+
+// transform applies the rate, unit conversion and scale of their metric definition to the points.
+// Definitions are by object type and metric, aggregates use the definition of the aggregated object type
+// except counts, which are not in the unit of the metric.
+// Rates convert milliseconds to a percentage of the duration covered by the samples of the point.
+func transform(points []backend.Point, metricdefs map[string]MetricDef) {
+	if len(metricdefs) == 0 {
+		return
+	}
+	for i := range points {
+		point := &points[i]
+		if point.Value < 0 {
+			continue
+		}
+		objectType, rollup := point.ObjectType, point.Rollup
+		if index := strings.Index(rollup, "_"); index > 0 {
+			if rollup[index+1:] == "count" {
+				continue
+			}
+			objectType, rollup = point.Instance, rollup[:index]
+		}
+		metricdef, ok := metricdefs[objectType+"."+point.Group+"."+point.Counter+"."+rollup]
+		if !ok {
+			continue
+		}
+		value := point.Value
+		if metricdef.Rate && point.Span > 0 {
+			value = value * 100 / float64(point.Span/time.Millisecond)
+		}
+		if len(metricdef.Unit) > 0 {
+			if factor, ok := unitConversions[metricdef.counterUnit][strings.ToLower(metricdef.Unit)]; ok {
+				value *= factor
+			}
+		}
+		if metricdef.Scale != 0 {
+			value *= metricdef.Scale
+		}
+		point.Value = value
+		point.Float = point.Float || metricdef.Rate || len(metricdef.Unit) > 0 || metricdef.Scale != 0
+	}
+}
+
+// derive computes the derived metrics of the objects having both their metrics
+func derive(points []backend.Point, derived []Derived) []backend.Point {
+	if len(derived) == 0 {
+		return nil
+	}
+	type objectKey struct {
+		objectType string
+		objectName string
+		instance   string
+		timestamp  int64
+	}
+	objects := make(map[objectKey]map[string]backend.Point)
+	keys := []objectKey{}
+	for _, point := range points {
+		key := objectKey{point.ObjectType, point.ObjectName, point.Instance, point.Timestamp}
+		metrics, ok := objects[key]
+		if !ok {
+			metrics = make(map[string]backend.Point)
+			objects[key] = metrics
+			keys = append(keys, key)
+		}
+		metrics[point.Group+"."+point.Counter+"."+point.Rollup] = point
+	}
+	results := []backend.Point{}
+	for _, key := range keys {
+		metrics := objects[key]
+		for _, d := range derived {
+			left, ok := metrics[strings.ToLower(d.Left)]
+			if !ok || left.Value < 0 {
+				continue
+			}
+			right, ok := metrics[strings.ToLower(d.Right)]
+			if !ok || right.Value < 0 {
+				continue
+			}
+			var value float64
+			switch d.Operator {
+			case "+":
+				value = left.Value + right.Value
+			case "-":
+				value = left.Value - right.Value
+			case "*":
+				value = left.Value * right.Value
+			case "/":
+				if right.Value == 0 {
+					continue
+				}
+				value = left.Value / right.Value
+			}
+			if d.Scale != 0 {
+				value *= d.Scale
+			}
+			parts := strings.Split(strings.ToLower(d.Metric), ".")
+			point := left
+			point.Group, point.Counter, point.Rollup = parts[0], parts[1], parts[2]
+			point.Value = value
+			point.Float = true
+			results = append(results, point)
+		}
+	}
+	return results
+}
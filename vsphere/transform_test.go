@@ -0,0 +1,98 @@
+package vsphere
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whpv/vsphere-graphite/backend"
+)
+
+func TestTransform(t *testing.T) {
+	metricdefs := map[string]MetricDef{
+		"virtualmachine.cpu.ready.summation":     {Metric: "cpu.ready.summation", Rate: true, counterUnit: "millisecond"},
+		"hostsystem.mem.consumed.average":        {Metric: "mem.consumed.average", Unit: "megabytes", counterUnit: "kiloBytes"},
+		"hostsystem.cpu.usage.average":           {Metric: "cpu.usage.average", Scale: 0.01, counterUnit: "percent"},
+		"hostsystem.net.usage.average":           {Metric: "net.usage.average", Unit: "bitspersecond", Scale: 0.5, counterUnit: "kiloBytesPerSecond"},
+		"hostsystem.cpu.usagemhz.average":        {Metric: "cpu.usagemhz.average", counterUnit: "megaHertz"},
+		"hostsystem.disk.maxtotallatency.latest": {Metric: "disk.maxTotalLatency.latest", Unit: "unknown", counterUnit: "millisecond"},
+	}
+	tests := []struct {
+		name  string
+		point backend.Point
+		value float64
+		float bool
+	}{
+		{"rate of a sum", backend.Point{ObjectType: "virtualmachine", Group: "cpu", Counter: "ready", Rollup: "summation", Value: 1200, Span: 3 * 20 * time.Second}, 2, true},
+		{"rate of an average", backend.Point{ObjectType: "virtualmachine", Group: "cpu", Counter: "ready", Rollup: "summation", Value: 400, Span: 20 * time.Second}, 2, true},
+		{"rate without span", backend.Point{ObjectType: "virtualmachine", Group: "cpu", Counter: "ready", Rollup: "summation", Value: 400}, 400, true},
+		{"unit", backend.Point{ObjectType: "hostsystem", Group: "mem", Counter: "consumed", Rollup: "average", Value: 2048}, 2, true},
+		{"scale", backend.Point{ObjectType: "hostsystem", Group: "cpu", Counter: "usage", Rollup: "average", Value: 4250}, 42.5, true},
+		{"unit then scale", backend.Point{ObjectType: "hostsystem", Group: "net", Counter: "usage", Rollup: "average", Value: 1}, 4096, true},
+		{"no transform", backend.Point{ObjectType: "hostsystem", Group: "cpu", Counter: "usagemhz", Rollup: "average", Value: 42}, 42, false},
+		{"unknown conversion", backend.Point{ObjectType: "hostsystem", Group: "disk", Counter: "maxtotallatency", Rollup: "latest", Value: 42}, 42, true},
+		{"no definition", backend.Point{ObjectType: "datastore", Group: "cpu", Counter: "usage", Rollup: "average", Value: 4250}, 4250, false},
+		{"missing sample", backend.Point{ObjectType: "hostsystem", Group: "cpu", Counter: "usage", Rollup: "average", Value: -1}, -1, false},
+		{"aggregate", backend.Point{ObjectType: "cluster", Group: "cpu", Counter: "usage", Instance: "hostsystem", Rollup: "average_max", Value: 4250}, 42.5, true},
+		{"aggregate rate", backend.Point{ObjectType: "cluster", Group: "cpu", Counter: "ready", Instance: "virtualmachine", Rollup: "summation_sum", Value: 2400, Span: 60 * time.Second}, 4, true},
+		{"aggregate count", backend.Point{ObjectType: "cluster", Group: "cpu", Counter: "usage", Instance: "hostsystem", Rollup: "average_count", Value: 3}, 3, false},
+	}
+	for _, test := range tests {
+		points := []backend.Point{test.point}
+		transform(points, metricdefs)
+		if math.Abs(points[0].Value-test.value) > 1e-9 {
+			t.Errorf("%s: value %v, want %v", test.name, points[0].Value, test.value)
+		}
+		if points[0].Float != test.float {
+			t.Errorf("%s: float %v, want %v", test.name, points[0].Float, test.float)
+		}
+	}
+}
+
+func TestDerive(t *testing.T) {
+	host := func(counter string, value float64) backend.Point {
+		return backend.Point{VCenter: "vc", ObjectType: "hostsystem", ObjectName: "esx1", Group: "mem", Counter: counter, Rollup: "average", Value: value, Timestamp: 100}
+	}
+	tests := []struct {
+		name    string
+		points  []backend.Point
+		derived Derived
+		values  []float64
+	}{
+		{"ratio", []backend.Point{host("consumed", 512), host("totalcapacity", 2048)},
+			Derived{Metric: "mem.consumed.percent", Left: "mem.consumed.average", Operator: "/", Right: "mem.totalCapacity.average", Scale: 100}, []float64{25}},
+		{"sum", []backend.Point{host("consumed", 512), host("totalcapacity", 2048)},
+			Derived{Metric: "mem.all.average", Left: "mem.consumed.average", Operator: "+", Right: "mem.totalcapacity.average"}, []float64{2560}},
+		{"difference", []backend.Point{host("consumed", 512), host("totalcapacity", 2048)},
+			Derived{Metric: "mem.free.average", Left: "mem.totalcapacity.average", Operator: "-", Right: "mem.consumed.average"}, []float64{1536}},
+		{"product", []backend.Point{host("consumed", 2), host("totalcapacity", 3)},
+			Derived{Metric: "mem.product.average", Left: "mem.consumed.average", Operator: "*", Right: "mem.totalcapacity.average"}, []float64{6}},
+		{"division by zero", []backend.Point{host("consumed", 512), host("totalcapacity", 0)},
+			Derived{Metric: "mem.consumed.percent", Left: "mem.consumed.average", Operator: "/", Right: "mem.totalcapacity.average"}, []float64{}},
+		{"missing operand", []backend.Point{host("consumed", 512)},
+			Derived{Metric: "mem.consumed.percent", Left: "mem.consumed.average", Operator: "/", Right: "mem.totalcapacity.average"}, []float64{}},
+		{"missing sample", []backend.Point{host("consumed", -1), host("totalcapacity", 2048)},
+			Derived{Metric: "mem.consumed.percent", Left: "mem.consumed.average", Operator: "/", Right: "mem.totalcapacity.average"}, []float64{}},
+		{"other timestamp", []backend.Point{host("consumed", 512), func() backend.Point { p := host("totalcapacity", 2048); p.Timestamp = 120; return p }()},
+			Derived{Metric: "mem.consumed.percent", Left: "mem.consumed.average", Operator: "/", Right: "mem.totalcapacity.average"}, []float64{}},
+	}
+	for _, test := range tests {
+		results := derive(test.points, []Derived{test.derived})
+		if len(results) != len(test.values) {
+			t.Errorf("%s: %d points, want %d", test.name, len(results), len(test.values))
+			continue
+		}
+		for i, result := range results {
+			if math.Abs(result.Value-test.values[i]) > 1e-9 {
+				t.Errorf("%s: value %v, want %v", test.name, result.Value, test.values[i])
+			}
+			if !result.Float || result.ObjectName != "esx1" || result.Timestamp != 100 {
+				t.Errorf("%s: unexpected point %+v", test.name, result)
+			}
+			if metric := result.Group + "." + result.Counter + "." + result.Rollup; metric != strings.ToLower(test.derived.Metric) {
+				t.Errorf("%s: metric %s, want %s", test.name, metric, test.derived.Metric)
+			}
+		}
+	}
+}
@@ -1,40 +1,68 @@
 package vsphere
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/whpv/vsphere-graphite/backend"
-	"github.com/whpv/vsphere-graphite/utils"
+	"github.com/whpv/vsphere-graphite/stats"
 
 	"golang.org/x/net/context"
 
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
-	"github.com/vmware/govmomi/find"
 )
 
 var stdlog, errlog *log.Logger
 
+// Debug enables the debug logs
+var Debug bool
+
 // VCenter description
 type VCenter struct {
-	Hostname     string
-	Username     string
-	Password     string
-	MetricGroups []*MetricGroup
+	Hostname         string
+	Username         string
+	Password         string
+	Offset           int
+	Jitter           int
+	Tags             bool
+	CustomAttributes bool
+	GuestInfo        bool
+	AvailableMetrics []string
+	IncludeInactive  bool
+	MetricGroups     []*MetricGroup
+	tagCache         *tagCache
+	availableCache   *availableCache
+	derived          []Derived
 }
 
 // Metric Definition
 type MetricDef struct {
-	Metric    string
-	Instances string
-	Key       int32
+	Metric           string
+	Instances        string
+	Key              int32
+	Level            int32
+	Preset           string
+	IncludeInstances []string
+	ExcludeInstances []string
+	Function         string
+	Aggregate        []string
+	Scale            float64
+	Unit             string
+	Rate             bool
+	selector         *selector
+	instances        *instanceFilter
+	counterUnit      string
 }
 
 // Metric Grouping for retrieval
@@ -48,12 +76,14 @@ type MetricGroup struct {
 type Metric struct {
 	ObjectType []string
 	Definition []MetricDef
+	Include    []Filter
+	Exclude    []Filter
+	Derived    []Derived
 }
 
-func (vcenter *VCenter) Connect() (*govmomi.Client, error) {
+// Connect to the vcenter, the context bounds the login
+func (vcenter *VCenter) Connect(ctx context.Context) (*govmomi.Client, error) {
 	// Prepare vCenter Connections
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	stdlog.Println("connecting to vcenter: " + vcenter.Hostname)
 	username := url.QueryEscape(vcenter.Username)
 	password := url.QueryEscape(vcenter.Password)
@@ -72,76 +102,385 @@ func (vcenter *VCenter) Connect() (*govmomi.Client, error) {
 	return client, nil
 }
 
-// Initialise vcenter
-func (vcenter *VCenter) Init(metrics []Metric, standardLogs *log.Logger, errorLogs *log.Logger) {
+// standalone tells if the client is connected to a standalone ESXi host rather than a vcenter
+func standalone(client *govmomi.Client) bool {
+	return client.ServiceContent.About.ApiType == "HostAgent"
+}
+
+// logout closes the vcenter session, even if the query context is already done
+func logout(client *govmomi.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client.Logout(ctx)
+}
+
+// Equals checks if two vcenters have the same settings (metric groups are ignored as Init computes them)
+func (vcenter *VCenter) Equals(other *VCenter) bool {
+	a := reflect.ValueOf(vcenter).Elem()
+	b := reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		if !a.Field(i).CanInterface() || a.Type().Field(i).Name == "MetricGroups" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Initialise vcenter, it returns an error if the vcenter could not be reached or the metrics resolved
+func (vcenter *VCenter) Init(metrics []Metric, standardLogs *log.Logger, errorLogs *log.Logger) error {
 	stdlog = standardLogs
 	errlog = errorLogs
+	// caches are created before the queries which share them
+	vcenter.tagCache = &tagCache{}
+	vcenter.availableCache = &availableCache{morToEntry: make(map[types.ManagedObjectReference]availableEntry)}
+	// metric groups are rebuilt from the metrics definition
+	vcenter.MetricGroups = nil
+	vcenter.derived = nil
+	for _, metric := range metrics {
+		vcenter.derived = append(vcenter.derived, metric.Derived...)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	client, err := vcenter.Connect()
-	defer client.Logout(ctx)
+	client, err := vcenter.Connect(ctx)
 	if err != nil {
 		errlog.Println("Could not connect to vcenter: ", vcenter.Hostname)
 		errlog.Println("Error: ", err)
-		return
+		return err
 	}
-	var perfmanager mo.PerformanceManager
-	err = client.RetrieveOne(ctx, *client.ServiceContent.PerfManager, nil, &perfmanager)
+	defer client.Logout(ctx)
+	if standalone(client) {
+		stdlog.Println("vcenter " + vcenter.Hostname + " is a standalone ESXi host")
+		if vcenter.Tags || vcenter.usesTags() {
+			errlog.Println("Tags are not available on standalone ESXi host " + vcenter.Hostname + ", they are ignored")
+		}
+	}
+	counters, err := retrievePerfCounters(ctx, client)
 	if err != nil {
 		errlog.Println("Could not get performance manager")
 		errlog.Println("Error: ", err)
-		return
+		return err
 	}
 
+	selectors := make([]*selector, len(metrics))
+	definitions := make([][]MetricDef, len(metrics))
+	for i, metric := range metrics {
+		definitions[i] = expandPresets(metric.Definition)
+		selectors[i], err = metric.selector()
+		if err != nil {
+			errlog.Println("Could not compile filters of metrics for " + strings.Join(metric.ObjectType, ", "))
+			errlog.Println("Error: ", err)
+			return err
+		}
+	}
 
-	for _, perf := range perfmanager.PerfCounter {
-		groupinfo := perf.GroupInfo.GetElementDescription()
-		nameinfo := perf.NameInfo.GetElementDescription()
-		identifier := groupinfo.Key + "." + nameinfo.Key + "." + fmt.Sprint(perf.RollupType)
-		for _, metric := range metrics {
-			for _, metricdef := range metric.Definition {
-				if metricdef.Metric == identifier {
-					metricd := MetricDef{Metric: metricdef.Metric, Instances: metricdef.Instances, Key: perf.Key}
-					for _, mtype := range metric.ObjectType {
-						added := false
-						for _, metricgroup := range vcenter.MetricGroups {
-							if metricgroup.ObjectType == mtype {
-								metricgroup.Metrics = append(metricgroup.Metrics, metricd)
-								stdlog.Println("Appended metric " + metricd.Metric + " identified by " + strconv.Itoa(int(metricd.Key)) + " to vcenter " + vcenter.Hostname + " for " + mtype)
-								added = true
+	// counters selected by wildcards and levels
+	expansions := make(map[*MetricDef][]string)
+	for _, perf := range counters {
+		identifier := counterName(perf)
+		for i, metric := range metrics {
+			metricdef := definitionFor(definitions[i], perf)
+			if metricdef == nil {
+				continue
+			}
+			if metricdef.expanded() {
+				expansions[metricdef] = append(expansions[metricdef], identifier)
+			}
+			metricd := *metricdef
+			metricd.Metric = identifier
+			metricd.Key = perf.Key
+			metricd.selector = selectors[i]
+			metricd.counterUnit = perf.UnitInfo.GetElementDescription().Key
+			metricd.instances, err = metricd.instanceFilter()
+			if err != nil {
+				errlog.Println("Could not compile instance filters of metric " + metricd.Metric)
+				errlog.Println("Error: ", err)
+				continue
+			}
+			if metricd.instances != nil && len(metricd.Instances) == 0 {
+				// instances are filtered after the query
+				metricd.Instances = "*"
+			}
+			if _, ok := unitConversions[metricd.counterUnit][strings.ToLower(metricd.Unit)]; len(metricd.Unit) > 0 && !ok {
+				errlog.Println("Metric " + metricd.Metric + " in " + metricd.counterUnit + " cannot be converted to " + metricd.Unit)
+			}
+			for _, mtype := range metric.ObjectType {
+				added := false
+				for _, metricgroup := range vcenter.MetricGroups {
+					if metricgroup.ObjectType == mtype {
+						for _, other := range metricgroup.Metrics {
+							if other.Key == metricd.Key {
+								errlog.Println("Metric " + metricd.Metric + " is defined by several metrics for " + mtype + " in vcenter " + vcenter.Hostname + ", the last definition sets its function, instance filters, aggregates and transforms")
 								break
 							}
 						}
-						if !added {
-							metricgroup := MetricGroup{ObjectType: mtype, Metrics: []MetricDef{metricd}}
-							vcenter.MetricGroups = append(vcenter.MetricGroups, &metricgroup)
-							stdlog.Println("Appended metric group with " + metricd.Metric + " identified by " + strconv.Itoa(int(metricd.Key)) + " to vcenter " + vcenter.Hostname + " for " + mtype)
-						}
+						metricgroup.Metrics = append(metricgroup.Metrics, metricd)
+						stdlog.Println("Appended metric " + metricd.Metric + " identified by " + strconv.Itoa(int(metricd.Key)) + " to vcenter " + vcenter.Hostname + " for " + mtype)
+						added = true
+						break
 					}
 				}
+				if !added {
+					metricgroup := MetricGroup{ObjectType: mtype, Metrics: []MetricDef{metricd}}
+					vcenter.MetricGroups = append(vcenter.MetricGroups, &metricgroup)
+					stdlog.Println("Appended metric group with " + metricd.Metric + " identified by " + strconv.Itoa(int(metricd.Key)) + " to vcenter " + vcenter.Hostname + " for " + mtype)
+				}
+			}
+		}
+	}
+
+	for i, metric := range metrics {
+		for j := range definitions[i] {
+			metricdef := &definitions[i][j]
+			if identifiers, ok := expansions[metricdef]; ok {
+				stdlog.Println("Metric " + metricdef.selection() + " for " + strings.Join(metric.ObjectType, ", ") + " expanded to " + strings.Join(identifiers, ", ") + " in vcenter " + vcenter.Hostname)
+			}
+		}
+	}
+
+	for _, missing := range missingMetrics(counters, metrics) {
+		errlog.Println("Metric " + missing + " not found in vcenter " + vcenter.Hostname)
+	}
+	return nil
+}
+
+// Check connects to the vcenter and returns the configured metrics it does not know
+func (vcenter *VCenter) Check(metrics []Metric, standardLogs *log.Logger, errorLogs *log.Logger) ([]string, error) {
+	stdlog = standardLogs
+	errlog = errorLogs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := vcenter.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Logout(ctx)
+	counters, err := retrievePerfCounters(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return missingMetrics(counters, metrics), nil
+}
+
+// Counter describes a performance counter available in a vcenter
+type Counter struct {
+	Key         int32
+	Metric      string
+	Unit        string
+	StatsType   string
+	Level       int32
+	Description string
+	Instances   []string `json:",omitempty"`
+}
+
+// Counters lists the performance counters of the vcenter.
+// If an entity is specified ("Type:value" managed object reference, i.e.: VirtualMachine:vm-42)
+// only the counters available for this entity are returned with their instances.
+func (vcenter *VCenter) Counters(entity string, standardLogs *log.Logger, errorLogs *log.Logger) ([]Counter, error) {
+	stdlog = standardLogs
+	errlog = errorLogs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := vcenter.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Logout(ctx)
+	perfcounters, err := retrievePerfCounters(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var available map[int32][]string
+	if len(entity) > 0 {
+		parts := strings.SplitN(entity, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Entity " + entity + " is not a managed object reference (Type:value)")
+		}
+		req := types.QueryAvailablePerfMetric{
+			This:       *client.ServiceContent.PerfManager,
+			Entity:     types.ManagedObjectReference{Type: parts[0], Value: parts[1]},
+			IntervalId: 20,
+		}
+		res, err := methods.QueryAvailablePerfMetric(ctx, client.RoundTripper, &req)
+		if err != nil {
+			return nil, err
+		}
+		available = make(map[int32][]string)
+		for _, metricid := range res.Returnval {
+			available[metricid.CounterId] = append(available[metricid.CounterId], metricid.Instance)
+		}
+	}
+
+	counters := []Counter{}
+	for _, perf := range perfcounters {
+		counter := Counter{
+			Key:         perf.Key,
+			Metric:      counterName(perf),
+			Unit:        perf.UnitInfo.GetElementDescription().Key,
+			StatsType:   string(perf.StatsType),
+			Level:       perf.Level,
+			Description: perf.NameInfo.GetElementDescription().Summary,
+		}
+		if available != nil {
+			instances, ok := available[perf.Key]
+			if !ok {
+				continue
+			}
+			counter.Instances = instances
+		}
+		counters = append(counters, counter)
+	}
+	return counters, nil
+}
+
+// retrievePerfCounters gets the performance counters from the performance manager
+func retrievePerfCounters(ctx context.Context, client *govmomi.Client) ([]types.PerfCounterInfo, error) {
+	var perfmanager mo.PerformanceManager
+	err := client.RetrieveOne(ctx, *client.ServiceContent.PerfManager, nil, &perfmanager)
+	if err != nil {
+		return nil, err
+	}
+	return perfmanager.PerfCounter, nil
+}
+
+// counterName returns the group.counter.rollup identifier of a performance counter
+func counterName(perf types.PerfCounterInfo) string {
+	groupinfo := perf.GroupInfo.GetElementDescription()
+	nameinfo := perf.NameInfo.GetElementDescription()
+	return groupinfo.Key + "." + nameinfo.Key + "." + fmt.Sprint(perf.RollupType)
+}
+
+// missingMetrics lists the metric definitions that have no matching performance counter
+func missingMetrics(counters []types.PerfCounterInfo, metrics []Metric) []string {
+	missing := []string{}
+	for _, metric := range metrics {
+		for _, metricdef := range expandPresets(metric.Definition) {
+			found := false
+			for _, perf := range counters {
+				if metricdef.matches(perf) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, metricdef.selection())
 			}
 		}
 	}
+	return missing
 }
 
-// Query a vcenter
-func (vcenter *VCenter) Query(interval int, domain string, channel *chan []backend.Point) {
+// labels returns the dimensions of an object: datastore, network, host, cluster, datacenter, folder,
+// resource pool, vApp and guest os, its tags by category and its custom attributes
+func (vcenter *VCenter) labels(mor types.ManagedObjectReference, info *objectInfo, domain string,
+	morToName map[types.ManagedObjectReference]string,
+	vmToHost map[types.ManagedObjectReference]types.ManagedObjectReference,
+	vmToDatastore map[types.ManagedObjectReference][]types.ManagedObjectReference,
+	vmToNetwork map[types.ManagedObjectReference][]types.ManagedObjectReference,
+	vmToGuest map[types.ManagedObjectReference]string,
+	morToTags map[types.ManagedObjectReference][]objectTag,
+	morToAttributes map[types.ManagedObjectReference]map[string]string) map[string]string {
+	labels := make(map[string]string)
+	//tags and custom attributes first so they don't hide the inventory labels
+	if vcenter.Tags {
+		for _, tag := range morToTags[mor] {
+			if previous, ok := labels[tag.category]; ok {
+				labels[tag.category] = previous + "," + tag.name
+			} else {
+				labels[tag.category] = tag.name
+			}
+		}
+	}
+	for attribute, value := range morToAttributes[mor] {
+		labels[attribute] = value
+	}
+	//find datastore
+	if mors, ok := vmToDatastore[mor]; ok {
+		datastore := []string{}
+		for _, dsmor := range mors {
+			datastore = append(datastore, morToName[dsmor])
+		}
+		labels["datastore"] = strings.Join(datastore, ",")
+	}
+	//find network
+	if mors, ok := vmToNetwork[mor]; ok {
+		network := []string{}
+		for _, netmor := range mors {
+			network = append(network, morToName[netmor])
+		}
+		labels["network"] = strings.Join(network, ",")
+	}
+	//find host
+	if esximor, ok := vmToHost[mor]; ok {
+		labels["host"] = strings.ToLower(strings.Replace(morToName[esximor], domain, "", -1))
+	}
+	if guest, ok := vmToGuest[mor]; ok {
+		labels["guestos"] = guest
+	}
+	if info != nil {
+		if len(info.cluster) > 0 {
+			labels["cluster"] = info.cluster
+		}
+		if len(info.datacenter) > 0 {
+			labels["datacenter"] = info.datacenter
+		}
+		if info.folder != "/" {
+			labels["folder"] = info.folder
+		}
+		if len(info.resourcePool) > 0 {
+			labels["resourcepool"] = info.resourcePool
+		}
+		if len(info.vApp) > 0 {
+			labels["vapp"] = info.vApp
+		}
+	}
+	return labels
+}
+
+// usesTags checks if the filters of the metrics need the vSphere tags
+func (vcenter *VCenter) usesTags() bool {
+	for _, metricgroup := range vcenter.MetricGroups {
+		for _, metricdef := range metricgroup.Metrics {
+			if metricdef.selector.usesTags() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait before collecting this vcenter in an interval: offset plus a random jitter
+func (vcenter *VCenter) Delay() time.Duration {
+	delay := time.Duration(vcenter.Offset) * time.Second
+	if vcenter.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(vcenter.Jitter) * int64(time.Second)))
+	}
+	return delay
+}
+
+// Query a vcenter, the context bounds the duration of the query
+func (vcenter *VCenter) Query(ctx context.Context, interval int, domain string, channel *chan []backend.Point) {
 	stdlog.Println("Setting up query inventory of vcenter: ", vcenter.Hostname)
+	start := time.Now()
 
 	// Create the contect
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// Get the client
-	client, err := vcenter.Connect()
+	client, err := vcenter.Connect(ctx)
 	if err != nil {
 		errlog.Println("Could not connect to vcenter: ", vcenter.Hostname)
 		errlog.Println("Error: ", err)
+		stats.Add(vcenter.Hostname, "query.errors", 1)
 		return
 	}
 
 	// wait to be properly connected to defer logout
-	defer client.Logout(ctx)
+	defer logout(client)
 
 	// Create the view manager
 	var viewManager mo.ViewManager
@@ -149,27 +488,31 @@ func (vcenter *VCenter) Query(interval int, domain string, channel *chan []backe
 	if err != nil {
 		errlog.Println("Could not get view manager from vcenter: " + vcenter.Hostname)
 		errlog.Println("Error: ", err)
+		stats.Add(vcenter.Hostname, "query.errors", 1)
 		return
 	}
 
-	// Get the Datacenters from root folder
-	var rootFolder mo.Folder
-	err = client.RetrieveOne(ctx, client.ServiceContent.RootFolder, nil, &rootFolder)
+	// Get the Datacenters from root folder, including the ones in folders
+	dcreq := types.CreateContainerView{This: viewManager.Reference(), Container: client.ServiceContent.RootFolder, Type: []string{"Datacenter"}, Recursive: true}
+	dcres, err := methods.CreateContainerView(ctx, client.RoundTripper, &dcreq)
 	if err != nil {
-		errlog.Println("Could not get root folder from vcenter: " + vcenter.Hostname)
+		errlog.Println("Could not create datacenter view from vcenter: " + vcenter.Hostname)
 		errlog.Println("Error: ", err)
+		stats.Add(vcenter.Hostname, "query.errors", 1)
 		return
 	}
-
-	datacenters := []types.ManagedObjectReference{}
-	for _, child := range rootFolder.ChildEntity {
-		if child.Type == "Datacenter" {
-			datacenters = append(datacenters, child)
-		}
+	var dcView mo.ContainerView
+	err = client.RetrieveOne(ctx, dcres.Returnval, nil, &dcView)
+	if err != nil {
+		errlog.Println("Could not get datacenters from vcenter: " + vcenter.Hostname)
+		errlog.Println("Error: ", err)
+		stats.Add(vcenter.Hostname, "query.errors", 1)
+		return
 	}
+	datacenters := dcView.View
 
 	// Get intresting object types from specified queries
-	objectTypes := []string{"ClusterComputeResource", "Datastore", "HostSystem", "DistributedVirtualPortgroup", "Network"}
+	objectTypes := []string{"ClusterComputeResource", "Datastore", "HostSystem", "DistributedVirtualPortgroup", "Network", "Folder", "ResourcePool"}
 	for _, group := range vcenter.MetricGroups {
 		found := false
 		for _, tmp := range objectTypes {
@@ -185,6 +528,7 @@ func (vcenter *VCenter) Query(interval int, domain string, channel *chan []backe
 
 	// Loop trought datacenters and create the intersting object reference list
 	mors := []types.ManagedObjectReference{}
+	morToDatacenter := make(map[types.ManagedObjectReference]types.ManagedObjectReference)
 	for _, datacenter := range datacenters {
 		// Create the CreateContentView request
 		req := types.CreateContainerView{This: viewManager.Reference(), Container: datacenter, Type: objectTypes, Recursive: true}
@@ -192,6 +536,7 @@ func (vcenter *VCenter) Query(interval int, domain string, channel *chan []backe
 		if err != nil {
 			errlog.Println("Could not create container view from vcenter: " + vcenter.Hostname)
 			errlog.Println("Error: ", err)
+			stats.Add(vcenter.Hostname, "query.errors", 1)
 			continue
 		}
 		// Retrieve the created ContentView
@@ -200,23 +545,35 @@ func (vcenter *VCenter) Query(interval int, domain string, channel *chan []backe
 		if err != nil {
 			errlog.Println("Could not get container view from vcenter: " + vcenter.Hostname)
 			errlog.Println("Error: ", err)
+			stats.Add(vcenter.Hostname, "query.errors", 1)
 			continue
 		}
 		// Add found object to object list
 		mors = append(mors, containerView.View...)
+		for _, mor := range containerView.View {
+			morToDatacenter[mor] = datacenter
+		}
 	}
 
 	//object for propery collection
 	var objectSet []types.ObjectSpec
-	for _, mor := range mors {
+	for _, mor := range append(mors, datacenters...) {
 		objectSet = append(objectSet, types.ObjectSpec{Obj: mor, Skip: types.NewBool(false)})
 	}
 
 	//properties specifications
 	propSet := []types.PropertySpec{}
-	propSet = append(propSet, types.PropertySpec{Type: "ManagedEntity", PathSet: []string{"name"}})
-	propSet = append(propSet, types.PropertySpec{Type: "VirtualMachine", PathSet: []string{"datastore", "network", "runtime.host"}})
-	propSet = append(propSet, types.PropertySpec{Type: "HostSystem", PathSet: []string{"parent"}})
+	entityProps := []string{"name", "parent"}
+	if vcenter.CustomAttributes {
+		entityProps = append(entityProps, "customValue")
+	}
+	propSet = append(propSet, types.PropertySpec{Type: "ManagedEntity", PathSet: entityProps})
+	vmProps := []string{"datastore", "network", "runtime.host", "resourcePool", "parentVApp", "config.guestId", "config.uuid", "config.instanceUuid", "runtime.powerState"}
+	if vcenter.GuestInfo {
+		vmProps = append(vmProps, guestProperties...)
+	}
+	propSet = append(propSet, types.PropertySpec{Type: "VirtualMachine", PathSet: vmProps})
+	propSet = append(propSet, types.PropertySpec{Type: "HostSystem", PathSet: []string{"hardware.systemInfo.uuid", "runtime.connectionState", "runtime.inMaintenanceMode"}})
 
 	//retrieve properties
 	propreq := types.RetrieveProperties{SpecSet: []types.PropertyFilterSpec{{ObjectSet: objectSet, PropSet: propSet}}}
@@ -224,6 +581,7 @@ func (vcenter *VCenter) Query(interval int, domain string, channel *chan []backe
 	if err != nil {
 		errlog.Println("Could not retrieve object names from vcenter: " + vcenter.Hostname)
 		errlog.Println("Error: ", err)
+		stats.Add(vcenter.Hostname, "query.errors", 1)
 		return
 	}
 
@@ -239,8 +597,39 @@ func (vcenter *VCenter) Query(interval int, domain string, channel *chan []backe
 	//create a map to resolve vm to host
 	vmToHost := make(map[types.ManagedObjectReference]types.ManagedObjectReference)
 
-	//create a map to resolve host to parent - in a cluster the parent should be a cluster
-	hostToParent := make(map[types.ManagedObjectReference]types.ManagedObjectReference)
+	//create a map to resolve vm to guest os
+	vmToGuest := make(map[types.ManagedObjectReference]string)
+
+	//create a map to resolve vm to resource pool
+	vmToResourcePool := make(map[types.ManagedObjectReference]types.ManagedObjectReference)
+
+	//create a map to resolve vm and host to uuid, the vm instance uuid is preferred to the bios uuid
+	morToUUID := make(map[types.ManagedObjectReference]string)
+	vmToInstanceUUID := make(map[types.ManagedObjectReference]string)
+
+	//create a map to resolve vm and host to runtime state
+	morToRuntime := make(map[types.ManagedObjectReference]*runtimeState)
+
+	//create a map to resolve vm to guest info
+	vmToGuestInfo := make(map[types.ManagedObjectReference]*guestInfo)
+
+	//create a map to resolve vm to vApp
+	vmToVApp := make(map[types.ManagedObjectReference]types.ManagedObjectReference)
+
+	//create a map to resolve object to parent - for a host in a cluster the parent should be a cluster
+	morToParent := make(map[types.ManagedObjectReference]types.ManagedObjectReference)
+
+	//create a map to resolve object to custom attributes
+	morToAttributes := make(map[types.ManagedObjectReference]map[string]string)
+	var customFields map[int32]string
+	if vcenter.CustomAttributes {
+		customFields, err = retrieveCustomFields(ctx, client)
+		if err != nil {
+			errlog.Println("Could not retrieve custom attributes definition from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			stats.Add(vcenter.Hostname, "query.errors", 1)
+		}
+	}
 
 	for _, objectContent := range propres.Returnval {
 		for _, Property := range objectContent.PropSet {
@@ -277,10 +666,78 @@ func (vcenter *VCenter) Query(interval int, domain string, channel *chan []backe
 				} else {
 					errlog.Println("Runtime host property of " + objectContent.Obj.String() + " was not a ManagedObjectReference, it was " + fmt.Sprintf("%T", Property.Val))
 				}
+			case "config.guestId":
+				guest, ok := Property.Val.(string)
+				if ok {
+					vmToGuest[objectContent.Obj] = guest
+				} else {
+					errlog.Println("Guest id property of " + objectContent.Obj.String() + " was not a string, it was " + fmt.Sprintf("%T", Property.Val))
+				}
+			case "config.uuid", "hardware.systemInfo.uuid":
+				uuid, ok := Property.Val.(string)
+				if ok {
+					morToUUID[objectContent.Obj] = uuid
+				} else {
+					errlog.Println("Uuid property of " + objectContent.Obj.String() + " was not a string, it was " + fmt.Sprintf("%T", Property.Val))
+				}
+			case "config.instanceUuid":
+				uuid, ok := Property.Val.(string)
+				if ok {
+					vmToInstanceUUID[objectContent.Obj] = uuid
+				} else {
+					errlog.Println("Instance uuid property of " + objectContent.Obj.String() + " was not a string, it was " + fmt.Sprintf("%T", Property.Val))
+				}
+			case "resourcePool":
+				mor, ok := Property.Val.(types.ManagedObjectReference)
+				if ok {
+					vmToResourcePool[objectContent.Obj] = mor
+				} else {
+					errlog.Println("Resource pool property of " + objectContent.Obj.String() + " was not a ManagedObjectReference, it was " + fmt.Sprintf("%T", Property.Val))
+				}
+			case "customValue":
+				values, ok := Property.Val.(types.ArrayOfCustomFieldValue)
+				if ok {
+					attributes := make(map[string]string)
+					for _, basevalue := range values.CustomFieldValue {
+						if value, ok := basevalue.(*types.CustomFieldStringValue); ok {
+							if fieldName, ok := customFields[value.Key]; ok && len(value.Value) > 0 {
+								attributes[fieldName] = value.Value
+							}
+						}
+					}
+					morToAttributes[objectContent.Obj] = attributes
+				} else {
+					errlog.Println("Custom value property of " + objectContent.Obj.String() + " was not an array of CustomFieldValue, it was " + fmt.Sprintf("%T", Property.Val))
+				}
+			case "guest.disk", "guest.toolsRunningStatus", "guest.guestState", "guest.net", "summary.quickStats":
+				guest, ok := vmToGuestInfo[objectContent.Obj]
+				if !ok {
+					guest = &guestInfo{}
+					vmToGuestInfo[objectContent.Obj] = guest
+				}
+				if !guest.set(Property) {
+					errlog.Println("Guest property " + Property.Name + " of " + objectContent.Obj.String() + " was not expected, it was " + fmt.Sprintf("%T", Property.Val))
+				}
+			case "runtime.powerState", "runtime.connectionState", "runtime.inMaintenanceMode":
+				state, ok := morToRuntime[objectContent.Obj]
+				if !ok {
+					state = &runtimeState{}
+					morToRuntime[objectContent.Obj] = state
+				}
+				if !state.set(Property) {
+					errlog.Println("Runtime property " + Property.Name + " of " + objectContent.Obj.String() + " was not expected, it was " + fmt.Sprintf("%T", Property.Val))
+				}
+			case "parentVApp":
+				mor, ok := Property.Val.(types.ManagedObjectReference)
+				if ok {
+					vmToVApp[objectContent.Obj] = mor
+				} else {
+					errlog.Println("Parent vApp property of " + objectContent.Obj.String() + " was not a ManagedObjectReference, it was " + fmt.Sprintf("%T", Property.Val))
+				}
 			case "parent":
 				mor, ok := Property.Val.(types.ManagedObjectReference)
 				if ok {
-					hostToParent[objectContent.Obj] = mor
+					morToParent[objectContent.Obj] = mor
 				} else {
 					errlog.Println("Parent property of " + objectContent.Obj.String() + " was not a ManagedObjectReference, it was " + fmt.Sprintf("%T", Property.Val))
 				}
@@ -301,140 +758,336 @@ func (vcenter *VCenter) Query(interval int, domain string, channel *chan []backe
 	// Create Queries from interesting objects and requested metrics
 
 	queries := []types.PerfQuerySpec{}
+	selectedMors := []types.ManagedObjectReference{}
 
 	// Common parameters
 	intervalId := int32(20)
-	endTime := time.Now().Add(time.Duration(-1) * time.Second)
-	startTime := endTime.Add(time.Duration(-interval-1) * time.Second)
+	vcName := strings.Replace(vcenter.Hostname, domain, "", -1)
+	endTime := time.Now()
+	startTime := queryStart(vcName, interval, endTime)
+
+	// One point per interval is kept, a window longer than three intervals (with the overlap) is a backfill
+	period := time.Duration(interval) * time.Second
+	if endTime.Sub(startTime) > 3*period {
+		stdlog.Println("Backfilling vcenter " + vcenter.Hostname + " since " + startTime.String())
+		stats.Add(vcenter.Hostname, "query.backfills", 1)
+	}
+	sent := sentSamples(vcName)
+	newest := make(map[types.ManagedObjectReference]time.Time)
+
+	// Retrieve the tags if filters or metrics need them, standalone hosts have no tagging service
+	var morToTags map[types.ManagedObjectReference][]objectTag
+	if (vcenter.Tags || vcenter.usesTags()) && !standalone(client) {
+		morToTags, err = vcenter.retrieveTags(ctx, client, mors)
+		if err != nil {
+			errlog.Println("Could not retrieve tags from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			stats.Add(vcenter.Hostname, "query.errors", 1)
+		}
+	}
+
+	// Inactive objects are not queried, only their state is sent
+	isInactive := func(mor types.ManagedObjectReference) bool {
+		state, ok := morToRuntime[mor]
+		return ok && !state.active() && !vcenter.IncludeInactive
+	}
+
+	// Get the counters available for the active objects, when checked
+	activeMors := []types.ManagedObjectReference{}
+	for _, mor := range mors {
+		if !isInactive(mor) {
+			activeMors = append(activeMors, mor)
+		}
+	}
+	available := vcenter.availableCounters(ctx, client, activeMors)
 
 	// Parse objects
+	filtered := 0
+	inactive := 0
+	morToInfo := make(map[types.ManagedObjectReference]*objectInfo)
 	for _, mor := range mors {
+		info := objectInfo{
+			name:       morToName[mor],
+			folder:     folderPath(mor, morToName, morToParent),
+			datacenter: morToName[morToDatacenter[mor]],
+			tags:       tagStrings(morToTags[mor]),
+		}
+		if mor.Type == "ClusterComputeResource" {
+			info.cluster = morToName[mor]
+		} else if parmor, ok := morToParent[mor]; ok && parmor.Type == "ClusterComputeResource" {
+			info.cluster = morToName[parmor]
+		} else if esximor, ok := vmToHost[mor]; ok {
+			if parmor, ok := morToParent[esximor]; ok && parmor.Type == "ClusterComputeResource" {
+				info.cluster = morToName[parmor]
+			}
+		}
+		if rpmor, ok := vmToResourcePool[mor]; ok {
+			info.resourcePool = morToName[rpmor]
+		}
+		if vappmor, ok := vmToVApp[mor]; ok {
+			info.vApp = morToName[vappmor]
+		} else if rpmor, ok := vmToResourcePool[mor]; ok && rpmor.Type == "VirtualApp" {
+			info.vApp = morToName[rpmor]
+		}
+		morToInfo[mor] = &info
+		counters, checked := available[mor]
+		unavailable := []string{}
 		metricIds := []types.PerfMetricId{}
+		selected := make(map[types.PerfMetricId]bool)
+		excluded := false
 		for _, metricgroup := range vcenter.MetricGroups {
 			if metricgroup.ObjectType == mor.Type {
 				for _, metricdef := range metricgroup.Metrics {
-					metricIds = append(metricIds, types.PerfMetricId{CounterId: metricdef.Key, Instance: metricdef.Instances})
+					if !metricdef.selector.selects(&info) {
+						excluded = true
+						continue
+					}
+					if checked && !counters[metricdef.Key] {
+						unavailable = append(unavailable, metricdef.Metric)
+						continue
+					}
+					metricId := types.PerfMetricId{CounterId: metricdef.Key, Instance: metricdef.Instances}
+					if selected[metricId] {
+						continue
+					}
+					selected[metricId] = true
+					metricIds = append(metricIds, metricId)
 				}
 			}
 		}
+		if excluded {
+			filtered++
+		}
+		if Debug && len(unavailable) > 0 {
+			stdlog.Println("Metrics " + strings.Join(unavailable, ", ") + " are not available for " + morToName[mor] + " (" + mor.String() + ") in vcenter " + vcenter.Hostname)
+		}
 		if len(metricIds) > 0 {
-			queries = append(queries, types.PerfQuerySpec{Entity: mor, StartTime: &startTime, EndTime: &endTime, MetricId: metricIds, IntervalId: intervalId})
+			selectedMors = append(selectedMors, mor)
+			if isInactive(mor) {
+				// powered off, disconnected or in maintenance: only the state is sent
+				inactive++
+				continue
+			}
+			queries = append(queries, types.PerfQuerySpec{Entity: mor, MetricId: metricIds, IntervalId: intervalId})
 		}
 	}
 
-	// Query the performances
-	perfreq := types.QueryPerf{This: *client.ServiceContent.PerfManager, QuerySpec: queries}
-	perfres, err := methods.QueryPerf(ctx, client.RoundTripper, &perfreq)
-	if err != nil {
-		errlog.Println("Could not request perfs from vcenter: " + vcenter.Hostname)
-		errlog.Println("Error: ", err)
-		return
+	for mor, uuid := range vmToInstanceUUID {
+		if len(uuid) > 0 {
+			morToUUID[mor] = uuid
+		}
 	}
-
-	// Get the result
-	values := []backend.Point{}
-	vcName := strings.Replace(vcenter.Hostname, domain, "", -1)
-	for _, base := range perfres.Returnval {
-		pem := base.(*types.PerfEntityMetric)
-		entityName := strings.ToLower(pem.Entity.Type)
-		name := strings.ToLower(strings.Replace(morToName[pem.Entity], domain, "", -1))
-		//find datastore
-		datastore := []string{}
-		if mors, ok := vmToDatastore[pem.Entity]; ok {
-			for _, mor := range mors {
-				datastore = append(datastore, morToName[mor])
+	vcenterUUID := client.ServiceContent.About.InstanceUuid
+	if len(vcenterUUID) == 0 && standalone(client) {
+		// a standalone host is identified by its hardware uuid
+		for mor, uuid := range morToUUID {
+			if mor.Type == "HostSystem" {
+				vcenterUUID = uuid
 			}
 		}
-		//find host and cluster
-		vmhost := ""
-		cluster := ""
-		if esximor, ok := vmToHost[pem.Entity]; ok {
-			vmhost = strings.ToLower(strings.Replace(morToName[esximor], domain, "", -1))
-			if parmor, ok := hostToParent[esximor]; ok {
-				if parmor.Type == "ClusterComputeResource" {
-					cluster = morToName[parmor]
-				}
+	}
+
+	// Functions collapsing the series and instance filters by object type and counter
+	functions := make(map[string]map[int32]string)
+	instanceFilters := make(map[string]map[int32]*instanceFilter)
+	for _, metricgroup := range vcenter.MetricGroups {
+		if _, ok := functions[metricgroup.ObjectType]; !ok {
+			functions[metricgroup.ObjectType] = make(map[int32]string)
+			instanceFilters[metricgroup.ObjectType] = make(map[int32]*instanceFilter)
+		}
+		for _, metricdef := range metricgroup.Metrics {
+			if function := seriesFunction(metricdef); len(function) > 0 {
+				functions[metricgroup.ObjectType][metricdef.Key] = function
 			}
+			instanceFilters[metricgroup.ObjectType][metricdef.Key] = metricdef.instances
+		}
+	}
+
+	// Query the performances by chunks of the window
+	values := []backend.Point{}
+	for chunkStart := startTime; len(queries) > 0 && chunkStart.Before(endTime); {
+		chunkEnd := chunkStart.Add(backfillChunk)
+		if chunkEnd.After(endTime) {
+			chunkEnd = endTime
+		}
+		from, to := chunkStart, chunkEnd
+		for i := range queries {
+			queries[i].StartTime = &from
+			queries[i].EndTime = &to
 		}
-		//find cluster if entity is a host
-		if entityName == "hostsystem" {
-			if parmor, ok := hostToParent[pem.Entity]; ok {
-				if parmor.Type == "ClusterComputeResource" {
-					cluster = morToName[parmor]
+		chunkStart = chunkEnd
+
+		perfreq := types.QueryPerf{This: *client.ServiceContent.PerfManager, QuerySpec: queries}
+		perfres, err := methods.QueryPerf(ctx, client.RoundTripper, &perfreq)
+		if err != nil {
+			errlog.Println("Could not request perfs from vcenter: " + vcenter.Hostname)
+			errlog.Println("Error: ", err)
+			stats.Add(vcenter.Hostname, "query.errors", 1)
+			return
+		}
+
+		// Get the result
+		for _, base := range perfres.Returnval {
+			pem := base.(*types.PerfEntityMetric)
+			// the overlap of the window was already sent for most entities
+			first := firstUnsent(pem.SampleInfo, sent[pem.Entity.Value])
+			if first == len(pem.SampleInfo) {
+				continue
+			}
+			infos := pem.SampleInfo[first:]
+			if last := infos[len(infos)-1].Timestamp; last.After(newest[pem.Entity]) {
+				newest[pem.Entity] = last
+			}
+			entityName := strings.ToLower(pem.Entity.Type)
+			name := strings.ToLower(strings.Replace(morToName[pem.Entity], domain, "", -1))
+			labels := vcenter.labels(pem.Entity, morToInfo[pem.Entity], domain, morToName, vmToHost, vmToDatastore, vmToNetwork, vmToGuest, morToTags, morToAttributes)
+			for _, baseserie := range pem.Value {
+				serie := baseserie.(*types.PerfMetricIntSeries)
+				metricName := strings.ToLower(metricToName[serie.Id.CounterId])
+				instanceName := serie.Id.Instance
+				key := "vsphere." + vcName + "." + entityName + "." + name + "." + metricName
+				if len(instanceName) > 0 {
+					key += "." + strings.ToLower(strings.Replace(instanceName, ".", "_", -1))
+				}
+				metricparts := strings.Split(metricName, ".")
+				function, ok := functions[pem.Entity.Type][serie.Id.CounterId]
+				if !ok {
+					continue
+				}
+				if !instanceFilters[pem.Entity.Type][serie.Id.CounterId].selects(instanceName) {
+					continue
+				}
+				if len(serie.Value) <= first {
+					continue
+				}
+				for _, bucket := range bucketSamples(infos, serie.Value[first:], period) {
+					samples := make([]float64, len(bucket.values))
+					for i, sample := range bucket.values {
+						samples[i] = float64(sample)
+					}
+					value := aggregateFunctions[function](samples...)
+					if value < 0 {
+						// no valid sample in the bucket
+						continue
+					}
+					point := backend.Point{
+						VCenter:     vcName,
+						ObjectType:  entityName,
+						ObjectName:  name,
+						Group:       metricparts[0],
+						Counter:     metricparts[1],
+						Instance:    instanceName,
+						Rollup:      metricparts[2],
+						Value:       value,
+						Float:       floatFunctions[function],
+						Labels:      labels,
+						MoRef:       pem.Entity.Value,
+						VCenterUUID: vcenterUUID,
+						UUID:        morToUUID[pem.Entity],
+						Span:        bucket.span(function),
+						Timestamp:   bucket.timestamp.Unix(),
+					}
+					values = append(values, point)
 				}
 			}
 		}
-		//find network
-		network := []string{}
-		if mors, ok := vmToNetwork[pem.Entity]; ok {
-			for _, mor := range mors {
-				network = append(network, morToName[mor])
-			}
+	}
+
+	// Periods some entities don't have all the samples of yet are sent with the next query, so that aggregates are complete
+	complete := completeUntil(newest, endTime, period).Unix()
+	kept := values[:0]
+	for _, value := range values {
+		if value.Timestamp <= complete {
+			kept = append(kept, value)
 		}
-		for _, baseserie := range pem.Value {
-			serie := baseserie.(*types.PerfMetricIntSeries)
-			metricName := strings.ToLower(metricToName[serie.Id.CounterId])
-			instanceName := serie.Id.Instance
-			key := "vsphere." + vcName + "." + entityName + "." + name + "." + metricName
-			if len(instanceName) > 0 {
-				key += "." + strings.ToLower(strings.Replace(instanceName, ".", "_", -1))
-			}
-			var value int64 = -1
-			if strings.HasSuffix(metricName, ".average") {
-				value = utils.Average(serie.Value...)
-			} else if strings.HasSuffix(metricName, ".maximum") {
-				value = utils.Max(serie.Value...)
-			} else if strings.HasSuffix(metricName, ".minimum") {
-				value = utils.Min(serie.Value...)
-			} else if strings.HasSuffix(metricName, ".latest") {
-				value = serie.Value[len(serie.Value)-1]
-			} else if strings.HasSuffix(metricName, ".summation") {
-				value = utils.Sum(serie.Value...)
+	}
+	values = kept
+
+	// Add the runtime state and guest info of the selected objects, timestamped with the last sample.
+	// Without samples they are stamped with the end of the query and are not committed to the state.
+	timestamp := endTime.Unix()
+	if len(values) > 0 {
+		timestamp = values[0].Timestamp
+		for _, value := range values {
+			if value.Timestamp > timestamp {
+				timestamp = value.Timestamp
 			}
-			metricparts := strings.Split(metricName, ".")
-			point := backend.Point{
-				VCenter:    vcName,
-				ObjectType: entityName,
-				ObjectName: name,
-				Group:      metricparts[0],
-				Counter:    metricparts[1],
-				Instance:   instanceName,
-				Rollup:     metricparts[2],
-				Value:      value,
-				Datastore:  datastore,
-				ESXi:       vmhost,
-				Cluster:    cluster,
-				Network:    network,
-				Timestamp:  endTime.Unix(),
+		}
+	}
+	for _, mor := range selectedMors {
+		state, stateOk := morToRuntime[mor]
+		guest, guestOk := vmToGuestInfo[mor]
+		if !stateOk && !guestOk {
+			continue
+		}
+		template := backend.Point{
+			VCenter:     vcName,
+			ObjectType:  strings.ToLower(mor.Type),
+			ObjectName:  strings.ToLower(strings.Replace(morToName[mor], domain, "", -1)),
+			Labels:      vcenter.labels(mor, morToInfo[mor], domain, morToName, vmToHost, vmToDatastore, vmToNetwork, vmToGuest, morToTags, morToAttributes),
+			MoRef:       mor.Value,
+			VCenterUUID: vcenterUUID,
+			UUID:        morToUUID[mor],
+			Timestamp:   timestamp,
+		}
+		if stateOk {
+			values = append(values, state.points(template)...)
+		}
+		if guestOk {
+			values = append(values, guest.points(template)...)
+		}
+	}
+
+	// Aggregate the points by cluster, datacenter and vcenter, then transform them and compute the derived metrics
+	aggregates := make(map[string][]string)
+	metricdefs := make(map[string]MetricDef)
+	for _, metricgroup := range vcenter.MetricGroups {
+		for _, metricdef := range metricgroup.Metrics {
+			key := strings.ToLower(metricgroup.ObjectType + "." + metricdef.Metric)
+			metricdefs[key] = metricdef
+			if len(metricdef.Aggregate) > 0 {
+				aggregates[key] = metricdef.Aggregate
 			}
-			values = append(values, point)
 		}
 	}
+	values = append(values, aggregate(values, aggregates)...)
+	transform(values, metricdefs)
+	values = append(values, derive(values, vcenter.derived)...)
+
+	stats.Set(vcenter.Hostname, "query.duration", int64(time.Since(start)/time.Millisecond))
+	stats.Set(vcenter.Hostname, "query.objects", int64(len(mors)))
+	stats.Set(vcenter.Hostname, "query.filtered", int64(filtered))
+	stats.Set(vcenter.Hostname, "query.inactive", int64(inactive))
+	stats.Set(vcenter.Hostname, "query.points", int64(len(values)))
+	stats.Set(vcenter.Hostname, "query.last", time.Now().Unix())
 	*channel <- values
 }
 
-func (vcenter *VCenter) QueryFinder(channel *chan  backend.FinderStuct) {
-	ctx, cancel := context.WithCancel(context.Background())
+// QueryFinder lists the objects of the vcenter, the context bounds the duration of the listing
+func (vcenter *VCenter) QueryFinder(ctx context.Context, channel *chan backend.FinderStuct) {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	// Get the client
-	client, err := vcenter.Connect()
+	client, err := vcenter.Connect(ctx)
 	if err != nil {
 		errlog.Println("Could not connect to vcenter: ", vcenter.Hostname)
 		errlog.Println("Error: ", err)
+		stats.Add(vcenter.Hostname, "finder.errors", 1)
 		return
 	}
 
 	// wait to be properly connected to defer logout
-	defer client.Logout(ctx)
+	defer logout(client)
 
 	finder := find.NewFinder(client.Client, true)
 	es, err := finder.ManagedObjectListChildren(ctx, "./...")
 	if err != nil {
+		errlog.Println("Could not list objects from vcenter: " + vcenter.Hostname)
+		errlog.Println("Error: ", err)
+		stats.Add(vcenter.Hostname, "finder.errors", 1)
 		return
 	}
 
-
-
 	values := []backend.FinderInfo{}
 
 	for _, e := range es {
@@ -451,7 +1104,6 @@ func (vcenter *VCenter) QueryFinder(channel *chan  backend.FinderStuct) {
 			tmp, _ := e.Object.(mo.VirtualMachine)
 			name = tmp.Name
 
-
 		case "ResourcePool":
 			tmp, _ := e.Object.(mo.ResourcePool)
 			name = tmp.Name
@@ -470,11 +1122,10 @@ func (vcenter *VCenter) QueryFinder(channel *chan  backend.FinderStuct) {
 		case "ClusterComputeResource":
 			tmp, _ := e.Object.(mo.ClusterComputeResource)
 			name = tmp.Name
-		default :
-			fmt.Println(e.Object.Reference().Type )
+		default:
+			fmt.Println(e.Object.Reference().Type)
 		}
 
-
 		/*if name == "" {
 			fmt.Println(name)
 		}*/
@@ -508,6 +1159,7 @@ func (vcenter *VCenter) QueryFinder(channel *chan  backend.FinderStuct) {
 	var finderS backend.FinderStuct
 	finderS.Host = vcenter.Hostname
 	finderS.Infos = values
+	stats.Set(vcenter.Hostname, "finder.objects", int64(len(values)))
 	*channel <- finderS
 
 	//vcenter.postFinder(es)